@@ -12,6 +12,7 @@ package main // import "tailscale.com/cmd/tailscaled"
 import (
 	"context"
 	"errors"
+	"expvar"
 	"flag"
 	"fmt"
 	"log"
@@ -250,6 +251,11 @@ func run() error {
 		logf("wgengine.New: %v", err)
 		return err
 	}
+	if re, ok := e.(wgengine.ResolvingEngine); ok {
+		if r, ok := re.GetResolver(); ok {
+			expvar.Publish("dns_forwarder", r.ExpVar())
+		}
+	}
 
 	var ns *netstack.Impl
 	if useNetstack || wrapNetstack {
@@ -373,6 +379,7 @@ func tryEngine(logf logger.Logf, linkMon *monitor.Mon, name string) (e wgengine.
 
 func newDebugMux() *http.ServeMux {
 	mux := http.NewServeMux()
+	mux.Handle("/debug/vars", expvar.Handler())
 	mux.HandleFunc("/debug/pprof/", pprof.Index)
 	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
 	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
@@ -33,6 +33,7 @@ import (
 	"tailscale.com/ipn/ipnstate"
 	"tailscale.com/ipn/policy"
 	"tailscale.com/net/dns"
+	"tailscale.com/net/dns/resolver"
 	"tailscale.com/net/interfaces"
 	"tailscale.com/net/tsaddr"
 	"tailscale.com/paths"
@@ -67,6 +68,103 @@ func getControlDebugFlags() []string {
 	return nil
 }
 
+var (
+	dnsDebugOnce  sync.Once
+	dnsDoHOptions resolver.DoHOptions
+	dnsUDPQueryID resolver.QueryIDStrategy
+)
+
+// dnsDebugOptions returns the DNS tuning set by the TS_DEBUG_DNS_*
+// environment variables. Invalid values are logged to logf, the first
+// time, and ignored, so that a typo can't make every DNS config fail
+// to apply.
+func dnsDebugOptions(logf logger.Logf) (resolver.DoHOptions, resolver.QueryIDStrategy) {
+	dnsDebugOnce.Do(func() {
+		o := &dnsDoHOptions
+		dnsEnv(logf, "TS_DEBUG_DNS_DOH_RACE", func(v string) error {
+			race, err := strconv.ParseBool(v)
+			if err != nil {
+				return err
+			}
+			o.Race = race
+			return nil
+		})
+		dnsEnv(logf, "TS_DEBUG_DNS_DOH_SELECTION", func(v string) error {
+			sel := resolver.DoHSelection(v)
+			if err := sel.Validate(); err != nil {
+				return err
+			}
+			o.Selection = sel
+			return nil
+		})
+		dnsEnv(logf, "TS_DEBUG_DNS_DOH_HEDGE_DELAY", func(v string) error {
+			d, err := time.ParseDuration(v)
+			if err != nil {
+				return err
+			}
+			o.HedgeDelay = d
+			return nil
+		})
+		dnsEnv(logf, "TS_DEBUG_DNS_DOH_QUERY_ID", func(v string) error {
+			qid := resolver.QueryIDStrategy(v)
+			if err := qid.Validate(); err != nil {
+				return err
+			}
+			o.QueryID = qid
+			return nil
+		})
+		dnsEnv(logf, "TS_DEBUG_DNS_DOH_MAX_INFLIGHT", func(v string) error {
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				return err
+			}
+			o.MaxInflight = n
+			return nil
+		})
+		dnsEnv(logf, "TS_DEBUG_DNS_DOH_FAIL_FAST", func(v string) error {
+			ff, err := strconv.ParseBool(v)
+			if err != nil {
+				return err
+			}
+			o.FailFast = ff
+			return nil
+		})
+		dnsEnv(logf, "TS_DEBUG_DNS_DOH_MAX_RESPONSE_BYTES", func(v string) error {
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				return err
+			}
+			if err := (resolver.DoHOptions{MaxResponseBytes: n}).Validate(); err != nil {
+				return err
+			}
+			o.MaxResponseBytes = n
+			return nil
+		})
+		dnsEnv(logf, "TS_DEBUG_DNS_UDP_QUERY_ID", func(v string) error {
+			qid := resolver.QueryIDStrategy(v)
+			if err := qid.Validate(); err != nil {
+				return err
+			}
+			dnsUDPQueryID = qid
+			return nil
+		})
+	})
+	return dnsDoHOptions, dnsUDPQueryID
+}
+
+// dnsEnv calls set with the value of the environment variable name,
+// if it's set. set must only store the value if it's valid; if set
+// fails, the value is logged and ignored.
+func dnsEnv(logf logger.Logf, name string, set func(string) error) {
+	v := os.Getenv(name)
+	if v == "" {
+		return
+	}
+	if err := set(v); err != nil {
+		logf("ignoring %s=%q: %v", name, v, err)
+	}
+}
+
 // LocalBackend is the glue between the major pieces of the Tailscale
 // network software: the cloud control plane (via controlclient), the
 // network data plane (via wgengine), and the user-facing UIs and CLIs
@@ -1727,6 +1825,7 @@ func (b *LocalBackend) authReconfig() {
 		Routes: map[dnsname.FQDN][]netaddr.IPPort{},
 		Hosts:  map[dnsname.FQDN][]netaddr.IP{},
 	}
+	dcfg.DoH, dcfg.UDPQueryID = dnsDebugOptions(b.logf)
 
 	// Populate MagicDNS records. We do this unconditionally so that
 	// quad-100 can always respond to MagicDNS queries, even if the OS
@@ -7,6 +7,7 @@ package ipnlocal
 import (
 	"fmt"
 	"net/http"
+	"os"
 	"reflect"
 	"testing"
 	"time"
@@ -493,3 +494,30 @@ func TestFileTargets(t *testing.T) {
 	}
 	// (other cases handled by TestPeerAPIBase above)
 }
+
+func TestDNSEnv(t *testing.T) {
+	const name = "TS_DEBUG_DNS_TEST"
+	defer os.Unsetenv(name)
+
+	var calls []string
+	var logged int
+	logf := func(string, ...interface{}) { logged++ }
+	set := func(v string) error {
+		calls = append(calls, v)
+		return fmt.Errorf("bad value %q", v)
+	}
+
+	dnsEnv(logf, name, set)
+	if len(calls) != 0 || logged != 0 {
+		t.Fatalf("unset variable: set called with %q, %d lines logged", calls, logged)
+	}
+
+	os.Setenv(name, "bogus")
+	dnsEnv(logf, name, set)
+	if want := []string{"bogus"}; !reflect.DeepEqual(calls, want) {
+		t.Errorf("set called with %q; want %q", calls, want)
+	}
+	if logged != 1 {
+		t.Errorf("%d lines logged; want 1", logged)
+	}
+}
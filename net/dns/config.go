@@ -39,6 +39,12 @@ type Config struct {
 	// it to resolve, you also need to add appropriate routes to
 	// Routes.
 	Hosts map[dnsname.FQDN][]netaddr.IP
+	// DoH tunes how the internal resolver forwards queries to
+	// upstream resolvers that it upgrades to DNS-over-HTTPS.
+	DoH resolver.DoHOptions
+	// UDPQueryID is how the internal resolver chooses the DNS ID of
+	// queries it forwards over plain UDP.
+	UDPQueryID resolver.QueryIDStrategy
 }
 
 // WriteToBufioWriter write a debug version of c for logs to w, omitting
@@ -5,12 +5,30 @@
 package resolver
 
 import (
+	"bytes"
 	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
 	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
 	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"testing"
+	"time"
 
 	"golang.org/x/net/dns/dnsmessage"
+	"inet.af/netaddr"
+	"tailscale.com/metrics"
+	"tailscale.com/util/dnsname"
+	"tailscale.com/wgengine/monitor"
 )
 
 var testDoH = flag.Bool("test-doh", false, "do real DoH tests against the network")
@@ -48,11 +66,11 @@ func TestDoH(t *testing.T) {
 
 	for ip := range knownDoH {
 		t.Run(ip.String(), func(t *testing.T) {
-			urlBase, c, ok := f.getDoHClient(ip)
+			srv, c, ok := f.getDoHClient(ip)
 			if !ok {
 				t.Fatal("expected DoH")
 			}
-			res, err := f.sendDoH(context.Background(), urlBase, c, someDNSQuestion(t))
+			res, err := f.sendDoH(context.Background(), srv, c, someDNSQuestion(t))
 			if err != nil {
 				t.Fatal(err)
 			}
@@ -81,3 +99,1563 @@ func TestDoH(t *testing.T) {
 		})
 	}
 }
+
+func TestDoHConnReuse(t *testing.T) {
+	var bad bool
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if bad {
+			// An empty body would normally let the client reuse
+			// the connection, so the forwarder must close it.
+			w.Header().Set("Content-Type", "text/plain")
+			return
+		}
+		w.Header().Set("Content-Type", dohType)
+		w.Write(someDNSQuestion(t))
+	}))
+	defer ts.Close()
+
+	f := newForwarder(t.Logf, nil, nil, nil)
+	c := ts.Client()
+	send := func() error {
+		_, err := f.sendDoH(context.Background(), dohServer{urlTemplate: ts.URL}, c, someDNSQuestion(t))
+		return err
+	}
+
+	if err := send(); err != nil {
+		t.Fatal(err)
+	}
+	if err := send(); err != nil {
+		t.Fatal(err)
+	}
+	if got := f.dohConnReused.Value(); got != 1 {
+		t.Fatalf("after two good requests, reused = %v; want 1", got)
+	}
+
+	bad = true
+	if err := send(); err == nil {
+		t.Fatal("expected error for bad Content-Type")
+	}
+	bad = false
+	if err := send(); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := f.dohConnReused.Value(), int64(2); got != want {
+		t.Errorf("reused = %v; want %v", got, want)
+	}
+	if got, want := f.dohConnNew.Value(), int64(2); got != want {
+		t.Errorf("new = %v; want %v (connection after protocol error was reused)", got, want)
+	}
+
+	m := f.expVar().(*metrics.Set)
+	if got, want := m.Get("doh_requests_reused_conn").String(), "2"; got != want {
+		t.Errorf("doh_requests_reused_conn = %v; want %v", got, want)
+	}
+	if got, want := m.Get("doh_requests_new_conn").String(), "2"; got != want {
+		t.Errorf("doh_requests_new_conn = %v; want %v", got, want)
+	}
+}
+
+func TestDoHIDMismatchClosesConn(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Always answers with someDNSID, whatever the query's ID.
+		w.Header().Set("Content-Type", dohType)
+		w.Write(someDNSQuestion(t))
+	}))
+	defer ts.Close()
+
+	f := newForwarder(t.Logf, nil, nil, nil)
+	c := ts.Client()
+	srv := dohServer{urlTemplate: ts.URL}
+	if err := f.setDoHOptions(DoHOptions{QueryID: QueryIDZero}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.sendDoH(context.Background(), srv, c, someDNSQuestion(t)); err == nil {
+		t.Fatal("expected error for mismatched DNS ID")
+	}
+	f.setDoHOptions(DoHOptions{})
+	if _, err := f.sendDoH(context.Background(), srv, c, someDNSQuestion(t)); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := f.dohConnNew.Value(), int64(2); got != want {
+		t.Errorf("new = %v; want %v (connection after ID mismatch was reused)", got, want)
+	}
+}
+
+func TestDoHProtocolErrorKeepsHTTP2Conn(t *testing.T) {
+	var bad bool
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if bad {
+			w.Header().Set("Content-Type", "text/plain")
+			return
+		}
+		w.Header().Set("Content-Type", dohType)
+		w.Write(someDNSQuestion(t))
+	}))
+	ts.EnableHTTP2 = true
+	ts.StartTLS()
+	defer ts.Close()
+
+	f := newForwarder(t.Logf, nil, nil, nil)
+	c := ts.Client()
+	srv := dohServer{urlTemplate: ts.URL}
+	bad = true
+	if _, err := f.sendDoH(context.Background(), srv, c, someDNSQuestion(t)); err == nil {
+		t.Fatal("expected error for bad Content-Type")
+	}
+	bad = false
+	if _, err := f.sendDoH(context.Background(), srv, c, someDNSQuestion(t)); err != nil {
+		t.Fatal(err)
+	}
+	// The HTTP/2 connection may be carrying other queries, so it's
+	// kept open and reused.
+	if got, want := f.dohConnNew.Value(), int64(1); got != want {
+		t.Errorf("new = %v; want %v", got, want)
+	}
+}
+
+func TestDoHResponseTooLarge(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", dohType)
+		w.Write(make([]byte, 101))
+	}))
+	defer ts.Close()
+
+	r := newResolver(t)
+	defer r.Close()
+	f := r.forwarder
+	for _, n := range []int{-1, headerBytes - 1} {
+		if err := r.SetConfig(Config{DoH: DoHOptions{MaxResponseBytes: n}}); err == nil {
+			t.Errorf("SetConfig accepted MaxResponseBytes %d", n)
+		}
+	}
+	if err := r.SetConfig(Config{DoH: DoHOptions{MaxResponseBytes: 100}}); err != nil {
+		t.Fatal(err)
+	}
+	_, err := f.sendDoH(context.Background(), dohServer{urlTemplate: ts.URL}, ts.Client(), someDNSQuestion(t))
+	if err != errDoHResponseTooLarge {
+		t.Errorf("err = %v; want %v", err, errDoHResponseTooLarge)
+	}
+
+	if err := r.SetConfig(Config{DoH: DoHOptions{MaxResponseBytes: 101}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.sendDoH(context.Background(), dohServer{urlTemplate: ts.URL}, ts.Client(), someDNSQuestion(t)); err != nil {
+		t.Errorf("at limit: %v", err)
+	}
+}
+
+func TestDoHTruncated(t *testing.T) {
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{
+		ID:        someDNSID,
+		Response:  true,
+		Truncated: true,
+	})
+	resp, err := b.Finish()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", dohType)
+		w.Write(resp)
+	}))
+	defer ts.Close()
+
+	f := newForwarder(t.Logf, nil, nil, nil)
+	res, err := f.sendDoH(context.Background(), dohServer{urlTemplate: ts.URL}, ts.Client(), someDNSQuestion(t))
+	if err != errDoHTruncated {
+		t.Fatalf("err = %v; want %v", err, errDoHTruncated)
+	}
+	if !bytes.Equal(res, resp) {
+		t.Errorf("got response %q; want %q", res, resp)
+	}
+}
+
+// serveTCPDNS answers each DNS over TCP query on ln with answer(query),
+// until ln is closed.
+func serveTCPDNS(ln net.Listener, answer func(q []byte) []byte) {
+	for {
+		c, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer c.Close()
+			var n [2]byte
+			if _, err := io.ReadFull(c, n[:]); err != nil {
+				return
+			}
+			q := make([]byte, binary.BigEndian.Uint16(n[:]))
+			if _, err := io.ReadFull(c, q); err != nil {
+				return
+			}
+			res := answer(q)
+			binary.BigEndian.PutUint16(n[:], uint16(len(res)))
+			c.Write(append(n[:], res...))
+		}()
+	}
+}
+
+func TestUntruncate(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	var (
+		mu     sync.Mutex
+		answer []byte // body after the header
+		tc     bool
+	)
+	go serveTCPDNS(ln, func(q []byte) []byte {
+		mu.Lock()
+		defer mu.Unlock()
+		res := append(append([]byte(nil), q[:headerBytes]...), answer...)
+		res[2] |= 0x80 // QR bit
+		if tc {
+			res[2] |= 0x02 // TC bit
+		}
+		return res
+	})
+	dst := netaddr.MustParseIPPort(ln.Addr().String())
+
+	query := someDNSQuestion(t)
+	truncated := append([]byte(nil), query...)
+	truncated[2] |= 0x80 | 0x02 // QR and TC bits
+
+	f := newForwarder(t.Logf, nil, nil, nil)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	tests := []struct {
+		name     string
+		answer   []byte
+		tc       bool
+		wantFull bool
+	}{
+		{"full", []byte("answer"), false, true},
+		{"still_truncated", []byte("answer"), true, false},
+		{"too_large", make([]byte, maxResponseBytes), false, false},
+	}
+	for _, tt := range tests {
+		mu.Lock()
+		answer, tc = tt.answer, tt.tc
+		mu.Unlock()
+		got := f.untruncate(ctx, truncated, query, dst)
+		if gotFull := !bytes.Equal(got, truncated); gotFull != tt.wantFull {
+			t.Errorf("%s: got full answer = %v; want %v", tt.name, gotFull, tt.wantFull)
+		}
+		if tt.wantFull && !bytes.HasSuffix(got, tt.answer) {
+			t.Errorf("%s: got %q; want the TCP answer", tt.name, got)
+		}
+	}
+
+	ln.Close()
+	if got := f.untruncate(ctx, truncated, query, dst); !bytes.Equal(got, truncated) {
+		t.Errorf("with TCP down got %q; want the truncated answer", got)
+	}
+}
+
+func TestSendTCPLinkSelection(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go serveTCPDNS(ln, func(q []byte) []byte {
+		res := append([]byte(nil), q...)
+		res[2] |= 0x80 // QR bit
+		return res
+	})
+	dst := netaddr.MustParseIPPort(ln.Addr().String())
+
+	old := initListenConfig
+	defer func() { initListenConfig = old }()
+	var bound int32
+	initListenConfig = func(nc *net.ListenConfig, mon *monitor.Mon, tunName string) error {
+		if tunName != "special" {
+			t.Errorf("got tunName %q; want special", tunName)
+		}
+		nc.Control = func(network, address string, c syscall.RawConn) error {
+			atomic.AddInt32(&bound, 1)
+			return nil
+		}
+		return nil
+	}
+
+	f := newForwarder(t.Logf, nil, nil, linkSelFunc(func(ip netaddr.IP) string {
+		if ip == dst.IP() {
+			return "special"
+		}
+		return ""
+	}))
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := f.sendTCP(ctx, someDNSQuestion(t), dst); err != nil {
+		t.Fatal(err)
+	}
+	if atomic.LoadInt32(&bound) != 1 {
+		t.Error("TCP query wasn't bound to the selected link")
+	}
+}
+
+func TestSendTCPQueryID(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	upstreamIDs := make(chan uint16, 1)
+	go serveTCPDNS(ln, func(q []byte) []byte {
+		upstreamIDs <- binary.BigEndian.Uint16(q[0:2])
+		res := append([]byte(nil), q...)
+		res[2] |= 0x80 // QR bit
+		return res
+	})
+	dst := netaddr.MustParseIPPort(ln.Addr().String())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	strategies := map[string]QueryIDStrategy{
+		"passthrough": QueryIDPassthrough,
+		"zero":        QueryIDZero,
+		"random":      QueryIDRandom,
+	}
+	for name, s := range strategies {
+		t.Run(name, func(t *testing.T) {
+			f := newForwarder(t.Logf, nil, nil, nil)
+			// Only the UDP strategy applies; the DoH one is left
+			// at its default to show it doesn't.
+			f.setUDPQueryID(s)
+			query := someDNSQuestion(t)
+			res, err := f.sendTCP(ctx, query, dst)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := binary.BigEndian.Uint16(res[0:2]); got != someDNSID {
+				t.Errorf("response ID = %v; want client's %v", got, someDNSID)
+			}
+			up := <-upstreamIDs
+			switch s {
+			case QueryIDPassthrough:
+				if up != someDNSID {
+					t.Errorf("upstream ID = %v; want %v", up, someDNSID)
+				}
+			case QueryIDZero:
+				if up != 0 {
+					t.Errorf("upstream ID = %v; want 0", up)
+				}
+			}
+			if binary.BigEndian.Uint16(query[0:2]) != someDNSID {
+				t.Error("caller's query was modified")
+			}
+			if len(f.inflightIDs) != 0 {
+				t.Errorf("inflightIDs not released: %v", f.inflightIDs)
+			}
+		})
+	}
+}
+
+// serveUDPEcho answers each DNS query on pc with the query itself,
+// marked as a response, until pc is closed.
+func serveUDPEcho(pc net.PacketConn) {
+	buf := make([]byte, 512)
+	for {
+		n, addr, err := pc.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		res := append([]byte(nil), buf[:n]...)
+		res[2] |= 0x80 // QR bit
+		pc.WriteTo(res, addr)
+	}
+}
+
+// blockingRoundTripper is an http.RoundTripper that never answers,
+// reporting on canceled when a request's context is done.
+type blockingRoundTripper struct {
+	canceled chan bool
+}
+
+func (rt blockingRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	<-req.Context().Done()
+	rt.canceled <- true
+	return nil, req.Context().Err()
+}
+
+func TestDoHRace(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	go serveUDPEcho(pc)
+	dst := netaddr.MustParseIPPort(pc.LocalAddr().String())
+
+	rt := blockingRoundTripper{canceled: make(chan bool, 1)}
+	dc := &http.Client{Transport: rt}
+	f := newForwarder(t.Logf, nil, nil, nil)
+
+	if _, raced := f.raceResult(dst.IP()); raced {
+		t.Fatal("raced before any query")
+	}
+
+	query := someDNSQuestion(t)
+	closeOnCtxDone := new(closePool)
+	defer closeOnCtxDone.Close()
+	res, err := f.sendRace(context.Background(), getTxID(query), closeOnCtxDone, query, dst, dohServer{urlTemplate: "https://doh.test/dns-query"}, dc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res[2]&0x80 == 0 {
+		t.Fatalf("got a non-response %q", res)
+	}
+
+	select {
+	case <-rt.canceled:
+	case <-time.After(5 * time.Second):
+		t.Error("losing DoH request wasn't canceled")
+	}
+	if udpWon, raced := f.raceResult(dst.IP()); !raced || !udpWon {
+		t.Errorf("raceResult = %v, %v; want true, true", udpWon, raced)
+	}
+}
+
+// errRoundTripper is an http.RoundTripper that fails every request,
+// then closes failed.
+type errRoundTripper struct {
+	failed chan struct{}
+}
+
+func (rt errRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	defer close(rt.failed)
+	return nil, errors.New("no DoH here")
+}
+
+func TestDoHRaceDoHFailed(t *testing.T) {
+	rt := errRoundTripper{failed: make(chan struct{})}
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	go func() {
+		// Answer only after DoH has failed, so that UDP answers
+		// second.
+		buf := make([]byte, 1500)
+		n, addr, err := pc.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		<-rt.failed
+		time.Sleep(50 * time.Millisecond)
+		res := append([]byte(nil), buf[:n]...)
+		res[2] |= 0x80 // QR bit
+		pc.WriteTo(res, addr)
+	}()
+	dst := netaddr.MustParseIPPort(pc.LocalAddr().String())
+
+	f := newForwarder(t.Logf, nil, nil, nil)
+	query := someDNSQuestion(t)
+	closeOnCtxDone := new(closePool)
+	defer closeOnCtxDone.Close()
+	res, err := f.sendRace(context.Background(), getTxID(query), closeOnCtxDone, query, dst, dohServer{urlTemplate: "https://doh.test/dns-query"}, &http.Client{Transport: rt})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res[2]&0x80 == 0 {
+		t.Fatalf("got a non-response %q", res)
+	}
+	// DoH failing isn't UDP being faster.
+	if udpWon, raced := f.raceResult(dst.IP()); raced {
+		t.Errorf("raceResult = %v, %v; want false, false", udpWon, raced)
+	}
+}
+
+func TestDoHRaceResultExpiry(t *testing.T) {
+	f := newForwarder(t.Logf, nil, nil, nil)
+	ip := netaddr.MustParseIP("1.1.1.1")
+
+	f.setRaceResult(ip, true)
+	if udpWon, raced := f.raceResult(ip); !raced || !udpWon {
+		t.Fatalf("raceResult = %v, %v; want true, true", udpWon, raced)
+	}
+	f.linkChange(true, nil)
+	if _, raced := f.raceResult(ip); raced {
+		t.Error("race result survived a link change")
+	}
+
+	f.setRaceResult(ip, true)
+	f.mu.Lock()
+	f.dohRaces[ip] = dohRace{udpWon: true, at: time.Now().Add(-dohRaceTTL - time.Second)}
+	f.mu.Unlock()
+	if _, raced := f.raceResult(ip); raced {
+		t.Error("race result didn't expire")
+	}
+}
+
+func TestExpandDoHTemplate(t *testing.T) {
+	packet := []byte{0, 0, 1, 0xfb, 0xff}
+	const enc = "AAAB-_8" // base64url of packet, unpadded
+	tests := []struct {
+		tmpl    string
+		want    string
+		usesDNS bool
+		wantErr bool
+	}{
+		{tmpl: "https://dns.example/dns-query", want: "https://dns.example/dns-query"},
+		{tmpl: "https://dns.example/dns-query{?dns}", want: "https://dns.example/dns-query?dns=" + enc, usesDNS: true},
+		{tmpl: "https://dns.example/q?ct=x{&dns}", want: "https://dns.example/q?ct=x&dns=" + enc, usesDNS: true},
+		{tmpl: "https://dns.example/q/{dns}", want: "https://dns.example/q/" + enc, usesDNS: true},
+		{tmpl: "https://dns.example/q{?other,dns}", want: "https://dns.example/q?dns=" + enc, usesDNS: true},
+		{tmpl: "https://dns.example/q{?other}", want: "https://dns.example/q"},
+		{tmpl: "https://dns.example/q{?dns", wantErr: true},
+		{tmpl: "https://dns.example/q{+dns}", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, usesDNS, err := expandDoHTemplate(tt.tmpl, packet)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%q: err = %v; want error %v", tt.tmpl, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want || usesDNS != tt.usesDNS {
+			t.Errorf("%q: got %q, %v; want %q, %v", tt.tmpl, got, usesDNS, tt.want, tt.usesDNS)
+		}
+	}
+}
+
+func TestDoHTemplateRequest(t *testing.T) {
+	query := someDNSQuestion(t)
+	reqc := make(chan *http.Request, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reqc <- r
+		w.Header().Set("Content-Type", dohType)
+		w.Write(query)
+	}))
+	defer ts.Close()
+
+	f := newForwarder(t.Logf, nil, nil, nil)
+	if _, err := f.sendDoH(context.Background(), dohServer{urlTemplate: ts.URL + "/custom/path{?dns}"}, ts.Client(), query); err != nil {
+		t.Fatal(err)
+	}
+	r := <-reqc
+	if r.Method != "GET" {
+		t.Errorf("method = %q; want GET", r.Method)
+	}
+	if r.URL.Path != "/custom/path" {
+		t.Errorf("path = %q; want /custom/path", r.URL.Path)
+	}
+	if got, want := r.URL.Query().Get("dns"), base64.RawURLEncoding.EncodeToString(query); got != want {
+		t.Errorf("dns param = %q; want %q", got, want)
+	}
+
+	if _, err := f.sendDoH(context.Background(), dohServer{urlTemplate: ts.URL + "/plain"}, ts.Client(), query); err != nil {
+		t.Fatal(err)
+	}
+	if r := <-reqc; r.Method != "POST" || r.URL.Path != "/plain" {
+		t.Errorf("got %s %s; want POST /plain", r.Method, r.URL.Path)
+	}
+}
+
+func TestDoHContentNegotiation(t *testing.T) {
+	const ct = "application/dns-udpwireformat"
+	query := someDNSQuestion(t)
+	reqc := make(chan *http.Request, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reqc <- r
+		w.Header().Set("Content-Type", ct)
+		w.Write(query)
+	}))
+	defer ts.Close()
+
+	f := newForwarder(t.Logf, nil, nil, nil)
+	srv := dohServer{
+		urlTemplate: ts.URL + "/v1/resolve",
+		contentType: ct,
+		accept:      ct,
+	}
+	if _, err := f.sendDoH(context.Background(), srv, ts.Client(), query); err != nil {
+		t.Fatal(err)
+	}
+	r := <-reqc
+	if r.URL.Path != "/v1/resolve" {
+		t.Errorf("path = %q; want /v1/resolve", r.URL.Path)
+	}
+	if got := r.Header.Get("Content-Type"); got != ct {
+		t.Errorf("Content-Type = %q; want %q", got, ct)
+	}
+	if got := r.Header.Get("Accept"); got != ct {
+		t.Errorf("Accept = %q; want %q", got, ct)
+	}
+
+	// The default media type is no longer acceptable in responses.
+	srv.urlTemplate = ts.URL
+	srv.contentType = "application/x-other"
+	if _, err := f.sendDoH(context.Background(), srv, ts.Client(), query); err == nil {
+		t.Error("unexpected success with mismatched response Content-Type")
+	}
+	<-reqc
+}
+
+func TestParseDoHServer(t *testing.T) {
+	ip := netaddr.MustParseIP("10.0.0.53")
+	tests := []struct {
+		tmpl     string
+		wantPort uint16
+		wantErr  bool
+	}{
+		{"https://dns.example/dns-query", 443, false},
+		{"https://dns.example/a/b/c{?dns}", 443, false},
+		{"https://dns.example:8443/dns-query", 8443, false},
+		{"https://dns.example:0/dns-query", 0, true},
+		{"https://dns.example:65536/dns-query", 0, true},
+		{"http://dns.example/dns-query", 0, true},
+		{"dns.example/dns-query", 0, true},
+		{"https:///dns-query", 0, true},
+		{"https://dns.example/{dns", 0, true},
+		{"https://dns.example/%zz", 0, true},
+	}
+	for _, tt := range tests {
+		srv, err := parseDoHServer(DoHServer{IP: ip, URLTemplate: tt.tmpl})
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%q: err = %v; want error %v", tt.tmpl, err, tt.wantErr)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if srv.urlTemplate != tt.tmpl {
+			t.Errorf("%q: urlTemplate = %q", tt.tmpl, srv.urlTemplate)
+		}
+		if srv.port != tt.wantPort {
+			t.Errorf("%q: port = %d; want %d", tt.tmpl, srv.port, tt.wantPort)
+		}
+	}
+
+	const tmpl = "https://dns.example/dns-query"
+	for _, s := range []DoHServer{
+		{URLTemplate: tmpl},
+		{IP: ip, URLTemplate: tmpl, ContentType: "application/"},
+		{IP: ip, URLTemplate: tmpl, Accept: "a\r\nX-Evil: 1"},
+	} {
+		if _, err := parseDoHServer(s); err == nil {
+			t.Errorf("%+v: want error", s)
+		}
+	}
+}
+
+func TestDoHOptionsServers(t *testing.T) {
+	const ct = "application/dns-udpwireformat"
+	query := someDNSQuestion(t)
+	reqc := make(chan *http.Request, 1)
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reqc <- r
+		w.Header().Set("Content-Type", ct)
+		w.Write(query)
+	}))
+	defer ts.Close()
+
+	r := newResolver(t)
+	defer r.Close()
+	f := r.forwarder
+	ip := netaddr.MustParseIP("127.0.0.1")
+	bad := Config{DoH: DoHOptions{Servers: []DoHServer{{IP: ip, URLTemplate: "http://insecure.example/"}}}}
+	if err := r.SetConfig(bad); err == nil {
+		t.Fatal("SetConfig accepted a non-https DoH server")
+	}
+	if _, _, ok := f.getDoHClient(ip); ok {
+		t.Fatal("bad DoH server was registered")
+	}
+
+	// The URL names a host that doesn't resolve here, on the test
+	// server's port, so the query only gets there if it's dialed at
+	// the configured IP and the URL's port.
+	port := netaddr.MustParseIPPort(ts.Listener.Addr().String()).Port()
+	cfg := Config{DoH: DoHOptions{Servers: []DoHServer{{
+		IP:          ip,
+		URLTemplate: fmt.Sprintf("https://example.com:%d/custom/path", port),
+		ContentType: ct,
+		Accept:      ct,
+	}}}}
+	if err := r.SetConfig(cfg); err != nil {
+		t.Fatal(err)
+	}
+	srv, c, ok := f.getDoHClient(ip)
+	if !ok {
+		t.Fatal("configured DoH server not found")
+	}
+	// Trust the test server's certificate, which is for example.com.
+	c.Transport.(*http.Transport).TLSClientConfig = ts.Client().Transport.(*http.Transport).TLSClientConfig
+	if _, err := f.sendDoH(context.Background(), srv, c, query); err != nil {
+		t.Fatal(err)
+	}
+	req := <-reqc
+	if req.URL.Path != "/custom/path" {
+		t.Errorf("path = %q; want /custom/path", req.URL.Path)
+	}
+	if got := req.Header.Get("Content-Type"); got != ct {
+		t.Errorf("Content-Type = %q; want %q", got, ct)
+	}
+	if got := req.Header.Get("Accept"); got != ct {
+		t.Errorf("Accept = %q; want %q", got, ct)
+	}
+
+	// Well-known servers are still there.
+	if _, _, ok := f.getDoHClient(netaddr.MustParseIP("8.8.8.8")); !ok {
+		t.Error("well-known DoH server missing")
+	}
+}
+
+func TestDNSIDStrategy(t *testing.T) {
+	upstreamIDs := make(chan uint16, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q, _ := ioutil.ReadAll(r.Body)
+		upstreamIDs <- binary.BigEndian.Uint16(q[0:2])
+		q[2] |= 0x80 // QR bit
+		w.Header().Set("Content-Type", dohType)
+		w.Write(q)
+	}))
+	defer ts.Close()
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	go serveUDPEcho(pc)
+	dst := netaddr.MustParseIPPort(pc.LocalAddr().String())
+
+	clientID := func(t *testing.T, res []byte) {
+		t.Helper()
+		if got := binary.BigEndian.Uint16(res[0:2]); got != someDNSID {
+			t.Errorf("response ID = %v; want client's %v", got, someDNSID)
+		}
+	}
+
+	strategies := map[string]QueryIDStrategy{
+		"passthrough": QueryIDPassthrough,
+		"zero":        QueryIDZero,
+		"random":      QueryIDRandom,
+	}
+	for name, s := range strategies {
+		t.Run(name, func(t *testing.T) {
+			f := newForwarder(t.Logf, nil, nil, nil)
+			if err := f.setDoHOptions(DoHOptions{QueryID: s}); err != nil {
+				t.Fatal(err)
+			}
+			f.setUDPQueryID(s)
+			query := someDNSQuestion(t)
+
+			res, err := f.sendDoH(context.Background(), dohServer{urlTemplate: ts.URL}, ts.Client(), query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			clientID(t, res)
+			up := <-upstreamIDs
+			switch s {
+			case QueryIDPassthrough:
+				if up != someDNSID {
+					t.Errorf("upstream ID = %v; want %v", up, someDNSID)
+				}
+			case QueryIDZero:
+				if up != 0 {
+					t.Errorf("upstream ID = %v; want 0", up)
+				}
+			}
+
+			closeOnCtxDone := new(closePool)
+			defer closeOnCtxDone.Close()
+			res, err = f.sendUDP(context.Background(), getTxID(query), closeOnCtxDone, query, dst)
+			if err != nil {
+				t.Fatal(err)
+			}
+			clientID(t, res)
+
+			if binary.BigEndian.Uint16(query[0:2]) != someDNSID {
+				t.Error("caller's query was modified")
+			}
+			if len(f.inflightIDs) != 0 {
+				t.Errorf("inflightIDs not released: %v", f.inflightIDs)
+			}
+		})
+	}
+}
+
+func TestAllocIDCollision(t *testing.T) {
+	f := newForwarder(t.Logf, nil, nil, nil)
+	const free = 0x1234
+	f.inflightIDs = map[uint16]bool{}
+	for i := 0; i < 1<<16; i++ {
+		if i != free {
+			f.inflightIDs[uint16(i)] = true
+		}
+	}
+	if got, reserved := f.allocID(); got != free || !reserved {
+		t.Fatalf("allocID = %#x, %v; want the only free ID %#x, true", got, reserved, free)
+	}
+
+	// With every ID in flight, the query shares one, and mustn't
+	// release it from under the query that reserved it.
+	if _, reserved := f.allocID(); reserved {
+		t.Fatal("allocID reserved an ID with none free")
+	}
+	_, _, done := f.setQueryID(QueryIDRandom, someDNSQuestion(t))
+	done()
+	if n := len(f.inflightIDs); n != 1<<16 {
+		t.Fatalf("%d IDs in flight after sharing one; want %d", n, 1<<16)
+	}
+
+	f.inflightIDs = nil
+	seen := map[uint16]bool{}
+	for i := 0; i < 1000; i++ {
+		id, _ := f.allocID()
+		if seen[id] {
+			t.Fatalf("allocID returned in-flight ID %v", id)
+		}
+		seen[id] = true
+	}
+	for id := range seen {
+		f.releaseID(id)
+	}
+	if len(f.inflightIDs) != 0 {
+		t.Errorf("%d IDs still in flight after release", len(f.inflightIDs))
+	}
+}
+
+func TestDoHRaceWithSelection(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	go serveUDPEcho(pc)
+	dst := netaddr.MustParseIPPort(pc.LocalAddr().String())
+
+	responses := make(chan packet, 1)
+	f := newForwarder(t.Logf, responses, nil, nil)
+	defer f.Close()
+	if err := f.setDoHOptions(DoHOptions{
+		Race:      true,
+		Selection: DoHSelectRoundRobin,
+		Servers:   []DoHServer{{IP: dst.IP(), URLTemplate: "https://doh.test/dns-query"}},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	rt := blockingRoundTripper{canceled: make(chan bool, 1)}
+	f.mu.Lock()
+	f.dohClient = map[netaddr.IPPort]*http.Client{
+		netaddr.IPPortFrom(dst.IP(), 443): {Transport: rt},
+	}
+	f.mu.Unlock()
+	f.setRoutes([]route{{Suffix: ".", Resolvers: []netaddr.IPPort{dst}}})
+
+	if _, doh := f.orderDoH([]netaddr.IPPort{dst}); len(doh) != 1 {
+		t.Fatalf("doh = %v before racing; want [%v]", doh, dst)
+	}
+	// DoH never answers, so only racing it against plain UDP gets
+	// an answer.
+	if err := f.forward(packet{bs: someDNSQuestion(t)}); err != nil {
+		t.Fatal(err)
+	}
+	if res := (<-responses).bs; res[2]&0x80 == 0 {
+		t.Fatalf("got a non-response %q", res)
+	}
+	if udpWon, raced := f.raceResult(dst.IP()); !raced || !udpWon {
+		t.Errorf("raceResult = %v, %v; want true, true", udpWon, raced)
+	}
+	// Having lost, DoH is left out of the Selection.
+	if parallel, doh := f.orderDoH([]netaddr.IPPort{dst}); len(parallel) != 1 || len(doh) != 0 {
+		t.Errorf("after the race got %v, %v; want all in parallel", parallel, doh)
+	}
+}
+
+// echoRoundTripper is an http.RoundTripper that answers each DoH POST
+// with its own query, marked as a response, once release is closed.
+type echoRoundTripper struct {
+	calls   *int32
+	release chan struct{}
+}
+
+func (rt echoRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	atomic.AddInt32(rt.calls, 1)
+	q, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		return nil, err
+	}
+	<-rt.release
+	q[2] |= 0x80 // QR bit
+	return &http.Response{
+		StatusCode: 200,
+		Header:     http.Header{"Content-Type": {dohType}},
+		Body:       ioutil.NopCloser(bytes.NewReader(q)),
+	}, nil
+}
+
+func TestDoHShared(t *testing.T) {
+	const n = 10
+	var calls int32
+	rt := echoRoundTripper{calls: &calls, release: make(chan struct{})}
+	dc := &http.Client{Transport: rt}
+	f := newForwarder(t.Logf, nil, nil, nil)
+	srv := dohServer{urlTemplate: "https://doh.test/dns-query"}
+
+	query := someDNSQuestion(t)
+	type result struct {
+		id  uint16
+		res []byte
+		err error
+	}
+	resc := make(chan result, n)
+	for i := 0; i < n; i++ {
+		q := append([]byte(nil), query...)
+		id := uint16(1000 + i)
+		binary.BigEndian.PutUint16(q[0:2], id)
+		go func() {
+			res, err := f.sendDoHShared(context.Background(), srv, dc, q)
+			resc <- result{id, res, err}
+		}()
+	}
+
+	k, _ := dohQueryKey(srv, query)
+	waitDoHWaiters(t, f, k, n)
+	close(rt.release)
+
+	for i := 0; i < n; i++ {
+		r := <-resc
+		if r.err != nil {
+			t.Fatal(r.err)
+		}
+		if got := binary.BigEndian.Uint16(r.res[0:2]); got != r.id {
+			t.Errorf("response ID = %v; want %v", got, r.id)
+		}
+		if r.res[2]&0x80 == 0 {
+			t.Errorf("got a non-response %q", r.res)
+		}
+	}
+	if got := atomic.LoadInt32(&calls); got != 1 {
+		t.Errorf("upstream calls = %d; want 1", got)
+	}
+
+	// Once done, the query isn't shared anymore.
+	if _, err := f.sendDoHShared(context.Background(), srv, dc, query); err != nil {
+		t.Fatal(err)
+	}
+	if got := atomic.LoadInt32(&calls); got != 2 {
+		t.Errorf("upstream calls = %d; want 2", got)
+	}
+}
+
+// waitDoHWaiters waits for n callers to be waiting on the shared DoH
+// query k.
+func waitDoHWaiters(t *testing.T, f *forwarder, k dohKey, n int) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		f.mu.Lock()
+		call := f.dohCalls[k]
+		waiting := call != nil && call.waiters == n
+		f.mu.Unlock()
+		if waiting {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("timeout waiting for %d callers to share query", n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestDoHSharedFirstCallerCanceled(t *testing.T) {
+	var calls int32
+	rt := echoRoundTripper{calls: &calls, release: make(chan struct{})}
+	dc := &http.Client{Transport: rt}
+	f := newForwarder(t.Logf, nil, nil, nil)
+	srv := dohServer{urlTemplate: "https://doh.test/dns-query"}
+	query := someDNSQuestion(t)
+	k, _ := dohQueryKey(srv, query)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	firstErr := make(chan error, 1)
+	go func() {
+		_, err := f.sendDoHShared(ctx, srv, dc, query)
+		firstErr <- err
+	}()
+	waitDoHWaiters(t, f, k, 1)
+	secondRes := make(chan []byte, 1)
+	go func() {
+		res, err := f.sendDoHShared(context.Background(), srv, dc, query)
+		if err != nil {
+			t.Error(err)
+		}
+		secondRes <- res
+	}()
+	waitDoHWaiters(t, f, k, 2)
+
+	// The first caller giving up mustn't fail the second.
+	cancel()
+	if err := <-firstErr; err != context.Canceled {
+		t.Errorf("first caller got %v; want %v", err, context.Canceled)
+	}
+	close(rt.release)
+	if res := <-secondRes; res == nil || res[2]&0x80 == 0 {
+		t.Errorf("second caller got a non-response %q", res)
+	}
+	if got := atomic.LoadInt32(&calls); got != 1 {
+		t.Errorf("upstream calls = %d; want 1", got)
+	}
+}
+
+func TestDoHSharedAllCallersCanceled(t *testing.T) {
+	rt := blockingRoundTripper{canceled: make(chan bool, 1)}
+	dc := &http.Client{Transport: rt}
+	f := newForwarder(t.Logf, nil, nil, nil)
+	srv := dohServer{urlTemplate: "https://doh.test/dns-query"}
+	query := someDNSQuestion(t)
+	k, _ := dohQueryKey(srv, query)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errc := make(chan error, 1)
+	go func() {
+		_, err := f.sendDoHShared(ctx, srv, dc, query)
+		errc <- err
+	}()
+	waitDoHWaiters(t, f, k, 1)
+	cancel()
+	if err := <-errc; err != context.Canceled {
+		t.Errorf("got %v; want %v", err, context.Canceled)
+	}
+	select {
+	case <-rt.canceled:
+	case <-time.After(5 * time.Second):
+		t.Error("upstream query wasn't canceled once nobody was waiting")
+	}
+}
+
+func TestDoHSharedPerIP(t *testing.T) {
+	// 1.1.1.1 and 1.0.0.1 share a URL template, but a query to a
+	// black-holed 1.1.1.1 mustn't stall the same query to 1.0.0.1.
+	const tmpl = "https://cloudflare-dns.com/dns-query"
+	blocked := dohServer{ip: netaddr.MustParseIP("1.1.1.1"), urlTemplate: tmpl}
+	healthy := dohServer{ip: netaddr.MustParseIP("1.0.0.1"), urlTemplate: tmpl}
+	blockedRT := blockingRoundTripper{canceled: make(chan bool, 1)}
+	var calls int32
+	healthyRT := echoRoundTripper{calls: &calls, release: make(chan struct{})}
+	close(healthyRT.release)
+
+	f := newForwarder(t.Logf, nil, nil, nil)
+	query := someDNSQuestion(t)
+	k, _ := dohQueryKey(blocked, query)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go f.sendDoHShared(ctx, blocked, &http.Client{Transport: blockedRT}, query)
+	waitDoHWaiters(t, f, k, 1)
+
+	ctx2, cancel2 := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel2()
+	res, err := f.sendDoHShared(ctx2, healthy, &http.Client{Transport: healthyRT}, query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res[2]&0x80 == 0 {
+		t.Errorf("got a non-response %q", res)
+	}
+	if got := atomic.LoadInt32(&calls); got != 1 {
+		t.Errorf("upstream calls to %v = %d; want 1", healthy.ip, got)
+	}
+}
+
+// ednsDNSQuestion is like someDNSQuestion, but with an EDNS OPT
+// record that has the DO bit set per dnssecOK.
+func ednsDNSQuestion(t testing.TB, dnssecOK bool) []byte {
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{
+		RecursionDesired: true,
+		ID:               someDNSID,
+	})
+	b.StartQuestions()
+	b.Question(dnsmessage.Question{
+		Name:  dnsmessage.MustNewName("tailscale.com."),
+		Type:  dnsmessage.TypeA,
+		Class: dnsmessage.ClassINET,
+	})
+	b.StartAdditionals()
+	var hdr dnsmessage.ResourceHeader
+	if err := hdr.SetEDNS0(1232, dnsmessage.RCodeSuccess, dnssecOK); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.OPTResource(hdr, dnsmessage.OPTResource{}); err != nil {
+		t.Fatal(err)
+	}
+	msg, err := b.Finish()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return msg
+}
+
+func TestDoHSharedDifferentFlags(t *testing.T) {
+	// Queries for the same question that differ in how they're
+	// asked, such as a DNSSEC client setting DO or CD, would get
+	// different answers, so they mustn't share one.
+	cd := someDNSQuestion(t)
+	cd[3] |= 0x10 // CD bit
+	tests := []struct {
+		name string
+		a, b []byte
+	}{
+		{"do", ednsDNSQuestion(t, false), ednsDNSQuestion(t, true)},
+		{"cd", someDNSQuestion(t), cd},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var calls int32
+			rt := echoRoundTripper{calls: &calls, release: make(chan struct{})}
+			dc := &http.Client{Transport: rt}
+			f := newForwarder(t.Logf, nil, nil, nil)
+			srv := dohServer{urlTemplate: "https://doh.test/dns-query"}
+			ka, _ := dohQueryKey(srv, tt.a)
+			kb, _ := dohQueryKey(srv, tt.b)
+			if ka == kb {
+				t.Fatal("queries have the same key")
+			}
+
+			resc := make(chan []byte, 2)
+			for _, q := range [][]byte{tt.a, tt.b} {
+				q := q
+				go func() {
+					res, err := f.sendDoHShared(context.Background(), srv, dc, q)
+					if err != nil {
+						t.Error(err)
+					}
+					resc <- res
+				}()
+			}
+			waitDoHWaiters(t, f, ka, 1)
+			waitDoHWaiters(t, f, kb, 1)
+			close(rt.release)
+			got := map[string]bool{}
+			for i := 0; i < 2; i++ {
+				res := <-resc
+				res[2] &^= 0x80 // QR bit, which the echo set
+				got[string(res)] = true
+			}
+			if !got[string(tt.a)] || !got[string(tt.b)] {
+				t.Error("a query got the answer to the other")
+			}
+			if n := atomic.LoadInt32(&calls); n != 2 {
+				t.Errorf("upstream calls = %d; want 2", n)
+			}
+		})
+	}
+}
+
+func dohCandidates(rtts ...time.Duration) []dohCandidate {
+	var cands []dohCandidate
+	for i, rtt := range rtts {
+		ip := netaddr.IPv4(10, 0, 0, byte(i+1))
+		cands = append(cands, dohCandidate{ipp: netaddr.IPPortFrom(ip, 53), rtt: rtt})
+	}
+	return cands
+}
+
+func firstOctets(cands []dohCandidate) (ret []byte) {
+	for _, c := range cands {
+		ret = append(ret, c.ipp.IP().As4()[3])
+	}
+	return ret
+}
+
+func TestDoHRoundRobin(t *testing.T) {
+	var rr dohRoundRobin
+	want := [][]byte{{1, 2, 3}, {2, 3, 1}, {3, 1, 2}, {1, 2, 3}}
+	for i, w := range want {
+		if got := firstOctets(rr.Order(dohCandidates(0, 0, 0))); !bytes.Equal(got, w) {
+			t.Errorf("query %d: order = %v; want %v", i, got, w)
+		}
+	}
+}
+
+func TestDoHLatencyWeighted(t *testing.T) {
+	// With a fixed "random" draw in the middle of the range, the
+	// 1ms resolver outweighs the 100ms one ahead of it.
+	lw := dohLatencyWeighted{rand: func() float64 { return 0.5 }}
+	if got, want := firstOctets(lw.Order(dohCandidates(100*time.Millisecond, time.Millisecond))), []byte{2, 1}; !bytes.Equal(got, want) {
+		t.Errorf("order = %v; want %v", got, want)
+	}
+	// A draw at the very bottom still picks the first.
+	lw = dohLatencyWeighted{rand: func() float64 { return 0 }}
+	if got, want := firstOctets(lw.Order(dohCandidates(100*time.Millisecond, time.Millisecond))), []byte{1, 2}; !bytes.Equal(got, want) {
+		t.Errorf("order = %v; want %v", got, want)
+	}
+
+	// Over many queries the fast one is preferred in proportion
+	// to its speed, and an unmeasured one as if it were as fast.
+	lw = dohLatencyWeighted{rand: rand.New(rand.NewSource(1)).Float64}
+	first := map[byte]int{}
+	const n = 10000
+	for i := 0; i < n; i++ {
+		first[firstOctets(lw.Order(dohCandidates(90*time.Millisecond, 10*time.Millisecond, 0)))[0]]++
+	}
+	// Weights are 1/90 : 1/10 : 1/10, so 5%, 47.4% and 47.4% first.
+	for ip, want := range map[byte]float64{1: 0.053, 2: 0.474, 3: 0.474} {
+		if got := float64(first[ip]) / n; got < want-0.02 || got > want+0.02 {
+			t.Errorf("10.0.0.%d first %.3f of the time; want about %.3f", ip, got, want)
+		}
+	}
+}
+
+func TestOrderDoH(t *testing.T) {
+	f := newForwarder(t.Logf, nil, nil, nil)
+	resolvers := []netaddr.IPPort{
+		netaddr.MustParseIPPort("1.1.1.1:53"),
+		netaddr.MustParseIPPort("10.0.0.1:53"),
+		netaddr.MustParseIPPort("8.8.8.8:53"),
+	}
+	parallel, doh := f.orderDoH(resolvers)
+	if len(parallel) != 3 || doh != nil {
+		t.Fatalf("without a strategy got %v, %v; want all in parallel", parallel, doh)
+	}
+
+	f.dohStrategy = dohLatencyWeighted{rand: func() float64 { return 0.5 }}
+	f.observeDoHRTT(netaddr.MustParseIP("1.1.1.1"), 80*time.Millisecond)
+	f.observeDoHRTT(netaddr.MustParseIP("8.8.8.8"), 8*time.Millisecond)
+	parallel, doh = f.orderDoH(resolvers)
+	if len(parallel) != 1 || parallel[0] != resolvers[1] {
+		t.Errorf("parallel = %v; want [%v]", parallel, resolvers[1])
+	}
+	if len(doh) != 2 || doh[0] != resolvers[2] || doh[1] != resolvers[0] {
+		t.Errorf("doh = %v; want [%v %v]", doh, resolvers[2], resolvers[0])
+	}
+
+	// Resolvers that plain UDP beat aren't tried over DoH.
+	f.dohOpts.Race = true
+	f.setRaceResult(netaddr.MustParseIP("8.8.8.8"), true)
+	parallel, doh = f.orderDoH(resolvers)
+	if len(parallel) != 2 || parallel[1] != resolvers[2] {
+		t.Errorf("parallel = %v; want [%v %v]", parallel, resolvers[1], resolvers[2])
+	}
+	if len(doh) != 1 || doh[0] != resolvers[0] {
+		t.Errorf("doh = %v; want [%v]", doh, resolvers[0])
+	}
+}
+
+func TestTryInOrder(t *testing.T) {
+	cands := []netaddr.IPPort{
+		netaddr.MustParseIPPort("1.1.1.1:53"),
+		netaddr.MustParseIPPort("8.8.8.8:53"),
+		netaddr.MustParseIPPort("9.9.9.9:53"),
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// A black-holed first choice only holds things up for the
+	// hedge delay.
+	var mu sync.Mutex
+	var tried []netaddr.IPPort
+	ok := tryInOrder(ctx, cands, 10*time.Millisecond, func(ipp netaddr.IPPort) bool {
+		mu.Lock()
+		tried = append(tried, ipp)
+		mu.Unlock()
+		if ipp == cands[0] {
+			<-ctx.Done()
+			return false
+		}
+		return true
+	})
+	mu.Lock()
+	if !ok || len(tried) != 2 || tried[0] != cands[0] || tried[1] != cands[1] {
+		t.Errorf("black hole: got %v, tried %v; want true, tried %v", ok, tried, cands[:2])
+	}
+	mu.Unlock()
+
+	// A failure moves on to the next candidate without waiting.
+	var n int32
+	ok = tryInOrder(ctx, cands, time.Hour, func(ipp netaddr.IPPort) bool {
+		return atomic.AddInt32(&n, 1) == 3
+	})
+	if !ok || n != 3 {
+		t.Errorf("failures: got %v after %d tries; want true after 3", ok, n)
+	}
+
+	ok = tryInOrder(ctx, cands, time.Hour, func(netaddr.IPPort) bool { return false })
+	if ok {
+		t.Error("all failed: got true; want false")
+	}
+
+	cancel()
+	ok = tryInOrder(ctx, cands, time.Hour, func(netaddr.IPPort) bool {
+		<-ctx.Done()
+		return true
+	})
+	if ok {
+		t.Error("canceled: got true; want false")
+	}
+}
+
+func TestSetDoHOptions(t *testing.T) {
+	f := newForwarder(t.Logf, nil, nil, nil)
+	if err := f.setDoHOptions(DoHOptions{Selection: "fastest-please"}); err == nil {
+		t.Error("unknown Selection accepted")
+	}
+	if err := f.setDoHOptions(DoHOptions{Selection: DoHSelectRoundRobin}); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := f.dohStrategy.(*dohRoundRobin); !ok {
+		t.Errorf("round-robin strategy = %T", f.dohStrategy)
+	}
+
+	// A config that's rejected changes nothing, even the parts of it
+	// that were valid.
+	ip := netaddr.MustParseIP("10.0.0.53")
+	bad := DoHOptions{
+		Selection: "fastest-please",
+		Servers:   []DoHServer{{IP: ip, URLTemplate: "https://dns.example/dns-query"}},
+	}
+	if err := f.setDoHOptions(bad); err == nil {
+		t.Error("unknown Selection accepted")
+	}
+	if _, _, ok := f.getDoHClient(ip); ok {
+		t.Error("rejected config's DoH server was registered")
+	}
+	if got := f.dohOptions().Selection; got != DoHSelectRoundRobin {
+		t.Errorf("Selection after rejected config = %q; want %q", got, DoHSelectRoundRobin)
+	}
+
+	if err := f.setDoHOptions(DoHOptions{Selection: DoHSelectLatencyWeighted}); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := f.dohStrategy.(dohLatencyWeighted); !ok {
+		t.Errorf("latency-weighted strategy = %T", f.dohStrategy)
+	}
+	if err := f.setDoHOptions(DoHOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if f.dohStrategy != nil {
+		t.Errorf("default strategy = %T; want none", f.dohStrategy)
+	}
+	if got := f.dohHedgeDelay(); got != dohHedgeDelay {
+		t.Errorf("default hedge delay = %v; want %v", got, dohHedgeDelay)
+	}
+}
+
+func TestObserveDoHRTT(t *testing.T) {
+	f := newForwarder(t.Logf, nil, nil, nil)
+	ip := netaddr.MustParseIP("1.1.1.1")
+	f.observeDoHRTT(ip, 80*time.Millisecond)
+	if got := f.dohRTT[ip]; got != 80*time.Millisecond {
+		t.Errorf("first RTT = %v; want 80ms", got)
+	}
+	f.observeDoHRTT(ip, 0)
+	if got := f.dohRTT[ip]; got != 70*time.Millisecond {
+		t.Errorf("smoothed RTT = %v; want 70ms", got)
+	}
+}
+
+func TestDoHMaxInflight(t *testing.T) {
+	arrived := make(chan bool, 3)
+	release := make(chan bool, 3)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q, _ := ioutil.ReadAll(r.Body)
+		arrived <- true
+		<-release
+		q[2] |= 0x80 // QR bit
+		w.Header().Set("Content-Type", dohType)
+		w.Write(q)
+	}))
+	defer ts.Close()
+	defer close(release)
+
+	f := newForwarder(t.Logf, nil, nil, nil)
+	f.setDoHOptions(DoHOptions{MaxInflight: 2})
+	srv := dohServer{urlTemplate: ts.URL}
+	errc := make(chan error, 3)
+	for i := 0; i < 3; i++ {
+		go func() {
+			_, err := f.sendDoH(context.Background(), srv, ts.Client(), someDNSQuestion(t))
+			errc <- err
+		}()
+	}
+	for i := 0; i < 2; i++ {
+		<-arrived
+	}
+	select {
+	case <-arrived:
+		t.Fatal("third query sent while two were in flight")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	release <- true
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-arrived:
+	case <-time.After(5 * time.Second):
+		t.Fatal("third query not sent after one finished")
+	}
+
+	// With fail fast, a query over the limit fails immediately.
+	f.setDoHOptions(DoHOptions{MaxInflight: 2, FailFast: true})
+	if _, err := f.sendDoH(context.Background(), srv, ts.Client(), someDNSQuestion(t)); err != errDoHBusy {
+		t.Errorf("err = %v; want %v", err, errDoHBusy)
+	}
+
+	release <- true
+	release <- true
+	for i := 0; i < 2; i++ {
+		if err := <-errc; err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestDoHMaxInflightPerIP(t *testing.T) {
+	f := newForwarder(t.Logf, nil, nil, nil)
+	f.setDoHOptions(DoHOptions{MaxInflight: 1})
+	const tmpl = "https://cloudflare-dns.com/dns-query"
+	srv1 := dohServer{ip: netaddr.MustParseIP("1.1.1.1"), urlTemplate: tmpl}
+	srv2 := dohServer{ip: netaddr.MustParseIP("1.0.0.1"), urlTemplate: tmpl}
+
+	sem1, _, _ := f.dohSemaphore(srv1)
+	if !sem1.TryAcquire() {
+		t.Fatal("first acquire failed")
+	}
+	if sem, _, _ := f.dohSemaphore(srv1); sem.TryAcquire() {
+		t.Error("second query to the same IP went over the limit")
+	}
+	if sem, _, _ := f.dohSemaphore(srv2); !sem.TryAcquire() {
+		t.Error("query to another IP of the same provider was limited")
+	}
+}
+
+func TestLookupDualStack(t *testing.T) {
+	var (
+		mu      sync.Mutex
+		stallV6 bool
+	)
+	// arrived gets each query's type as it arrives. The A answer
+	// waits for the AAAA query to arrive too, so the test only
+	// passes if both are in flight at once.
+	arrived := make(chan dnsmessage.Type, 2)
+	aaaaArrived := make(chan bool)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q, _ := ioutil.ReadAll(r.Body)
+		var msg dnsmessage.Message
+		if err := msg.Unpack(q); err != nil || len(msg.Questions) != 1 {
+			http.Error(w, "bad query", 400)
+			return
+		}
+		question := msg.Questions[0]
+		arrived <- question.Type
+		msg.Response = true
+		hdr := dnsmessage.ResourceHeader{Name: question.Name, Class: dnsmessage.ClassINET}
+		switch question.Type {
+		case dnsmessage.TypeA:
+			select {
+			case <-aaaaArrived:
+			case <-time.After(5 * time.Second):
+			}
+			hdr.Type = dnsmessage.TypeA
+			msg.Answers = []dnsmessage.Resource{
+				{Header: hdr, Body: &dnsmessage.AResource{A: [4]byte{1, 2, 3, 4}}},
+				{Header: hdr, Body: &dnsmessage.AResource{A: [4]byte{5, 6, 7, 8}}},
+			}
+		case dnsmessage.TypeAAAA:
+			close(aaaaArrived)
+			mu.Lock()
+			stall := stallV6
+			mu.Unlock()
+			if stall {
+				<-r.Context().Done()
+				return
+			}
+			hdr.Type = dnsmessage.TypeAAAA
+			msg.Answers = []dnsmessage.Resource{
+				{Header: hdr, Body: &dnsmessage.AAAAResource{AAAA: [16]byte{0: 0x20, 1: 0x01, 15: 1}}},
+			}
+		}
+		res, err := msg.Pack()
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		w.Header().Set("Content-Type", dohType)
+		w.Write(res)
+	}))
+	defer ts.Close()
+
+	f := newForwarder(t.Logf, nil, nil, nil)
+	srv := dohServer{urlTemplate: ts.URL}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	dst := netaddr.MustParseIPPort("127.0.0.1:53")
+	res := f.lookupDualStack(ctx, dst, srv, ts.Client(), "example.com.")
+	if res.AErr != nil || res.AAAAErr != nil {
+		t.Fatalf("errors: A %v, AAAA %v", res.AErr, res.AAAAErr)
+	}
+	wantA := []netaddr.IP{netaddr.IPv4(1, 2, 3, 4), netaddr.IPv4(5, 6, 7, 8)}
+	if len(res.A) != 2 || res.A[0] != wantA[0] || res.A[1] != wantA[1] {
+		t.Errorf("A = %v; want %v", res.A, wantA)
+	}
+	wantAAAA := netaddr.IPFrom16([16]byte{0: 0x20, 1: 0x01, 15: 1})
+	if len(res.AAAA) != 1 || res.AAAA[0] != wantAAAA {
+		t.Errorf("AAAA = %v; want [%v]", res.AAAA, wantAAAA)
+	}
+	<-arrived
+	<-arrived
+
+	// A stalled AAAA lookup fails on its own, without losing the A
+	// answers.
+	mu.Lock()
+	stallV6 = true
+	mu.Unlock()
+	aaaaArrived = make(chan bool)
+	ctx, cancel = context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	res = f.lookupDualStack(ctx, dst, srv, ts.Client(), "example.com.")
+	if res.AErr != nil || len(res.A) != 2 {
+		t.Errorf("A = %v, %v; want 2 addresses", res.A, res.AErr)
+	}
+	if res.AAAAErr == nil {
+		t.Errorf("AAAA = %v; want a timeout error", res.AAAA)
+	}
+}
+
+func TestLookupDualStackRouted(t *testing.T) {
+	r := newResolver(t)
+	defer r.Close()
+	if err := r.SetConfig(Config{
+		Routes: map[dnsname.FQDN][]netaddr.IPPort{
+			".": {netaddr.MustParseIPPort("10.0.0.1:53")},
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.LookupDualStack(context.Background(), "example.com."); err == nil {
+		t.Error("lookup without a DoH-capable resolver succeeded")
+	}
+}
+
+func TestSetConfigRejected(t *testing.T) {
+	r := newResolver(t)
+	defer r.Close()
+	routes := map[dnsname.FQDN][]netaddr.IPPort{
+		".": {netaddr.MustParseIPPort("10.0.0.1:53")},
+	}
+	if err := r.SetConfig(Config{Routes: routes}); err != nil {
+		t.Fatal(err)
+	}
+
+	// A bad UDP query ID strategy rejects the whole config, without
+	// applying its otherwise valid DoH options or routes.
+	err := r.SetConfig(Config{
+		DoH:        DoHOptions{Race: true},
+		UDPQueryID: "rand",
+	})
+	if err == nil {
+		t.Fatal("SetConfig accepted an unknown UDP query ID strategy")
+	}
+	if r.forwarder.dohOptions().Race {
+		t.Error("rejected config's DoH options were applied")
+	}
+	if got := r.forwarder.resolvers("example.com."); len(got) != 1 {
+		t.Errorf("resolvers after rejected config = %v; want the old route", got)
+	}
+}
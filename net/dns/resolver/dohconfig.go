@@ -0,0 +1,217 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package resolver
+
+import (
+	"fmt"
+	"time"
+
+	"inet.af/netaddr"
+)
+
+// DoHOptions tunes how a Resolver forwards queries to the upstream
+// resolvers that it upgrades to DNS-over-HTTPS.
+// The zero value is the default behavior.
+type DoHOptions struct {
+	// Race, if true, makes the first query to each DoH-capable
+	// resolver go out over both DoH and plain UDP at once. If plain
+	// UDP answers while DoH is still pending, later queries to that
+	// resolver use plain UDP until the network changes or the result
+	// expires, after which the resolver is raced again.
+	//
+	// With a Selection, a resolver's first query is raced when the
+	// Selection gets to it, and resolvers that plain UDP beat are
+	// left out of the Selection, being queried over plain UDP
+	// alongside it instead.
+	Race bool
+
+	// Selection, if non-empty, makes each query try its DoH-capable
+	// resolvers one at a time, in the order the named strategy
+	// prefers, rather than all at once. Other than as Race allows,
+	// plain DNS is only used once DoH to all of them has failed.
+	Selection DoHSelection
+
+	// HedgeDelay is how long a query with a Selection waits for
+	// one DoH resolver to answer before also trying the next.
+	// If zero, 500ms is used.
+	HedgeDelay time.Duration
+
+	// QueryID is how the DNS ID of queries sent over DoH is chosen.
+	QueryID QueryIDStrategy
+
+	// MaxInflight, if positive, is the most DoH queries that may be
+	// in flight to each DoH server IP at once. Further queries wait
+	// for one to finish or, if FailFast, fail so that they fall back
+	// to plain DNS.
+	MaxInflight int
+	FailFast    bool
+
+	// MaxResponseBytes, if non-zero, is the largest DoH response
+	// body accepted. Larger responses are treated as errors. If
+	// zero, 64 KiB is used, which is larger than any DNS message.
+	MaxResponseBytes int
+
+	// Servers are DoH servers to use in place of plain DNS resolvers,
+	// in addition to (or instead of) the well-known public ones.
+	Servers []DoHServer
+}
+
+// Validate returns an error if o isn't valid, as Resolver.SetConfig
+// would.
+func (o DoHOptions) Validate() error {
+	_, err := parseDoHOptions(o)
+	return err
+}
+
+// DoHServer describes a DNS-over-HTTPS server to use in place of a
+// plain DNS resolver.
+type DoHServer struct {
+	// IP is the IP of the plain DNS resolver that the DoH server
+	// stands in for. Queries to it are sent over DoH to IP instead,
+	// on URLTemplate's port (443 if it has none).
+	IP netaddr.IP
+
+	// URLTemplate is the server's RFC 8484 URI template, including
+	// its full path, such as "https://dns.example/custom/path" or
+	// "https://dns.example/resolve{?dns}". Templates using the dns
+	// variable are sent queries with GET, others with POST.
+	URLTemplate string
+
+	// ContentType is the media type of queries and responses.
+	// If empty, RFC 8484's "application/dns-message" is used.
+	ContentType string
+
+	// Accept, if non-empty, is sent as the Accept header.
+	Accept string
+}
+
+// DoHSelection names a strategy for choosing among the DoH-capable
+// resolvers of a query. See DoHOptions.Selection.
+type DoHSelection string
+
+const (
+	// DoHSelectRoundRobin rotates through the resolvers, preferring
+	// the next one in line for each query.
+	DoHSelectRoundRobin DoHSelection = "round-robin"
+	// DoHSelectLatencyWeighted prefers resolvers at random, with a
+	// probability inversely proportional to their observed RTT.
+	DoHSelectLatencyWeighted DoHSelection = "latency-weighted"
+)
+
+// Validate returns an error if s is neither empty nor one of the
+// DoHSelection constants.
+func (s DoHSelection) Validate() error {
+	_, err := newDoHSelectionStrategy(s)
+	return err
+}
+
+// QueryIDStrategy is how the DNS ID of a query forwarded upstream is
+// chosen. Whatever ID goes upstream, the client gets its own ID back
+// in the response.
+type QueryIDStrategy string
+
+const (
+	// QueryIDPassthrough sends the client's ID unchanged.
+	QueryIDPassthrough QueryIDStrategy = ""
+	// QueryIDZero always sends ID 0, as RFC 8484 recommends for DoH
+	// so that responses are HTTP cache friendly.
+	QueryIDZero QueryIDStrategy = "zero"
+	// QueryIDRandom sends a random ID that's unique among the
+	// in-flight queries, so responses can't be mixed up and plain
+	// UDP responses are harder to spoof.
+	QueryIDRandom QueryIDStrategy = "random"
+)
+
+// Validate returns an error if s isn't one of the QueryIDStrategy
+// constants.
+func (s QueryIDStrategy) Validate() error {
+	switch s {
+	case QueryIDPassthrough, QueryIDZero, QueryIDRandom:
+		return nil
+	}
+	return fmt.Errorf("unknown DNS query ID strategy %q", s)
+}
+
+// dohConfig is a DoHOptions that parseDoHOptions has checked and
+// parsed, ready to apply.
+type dohConfig struct {
+	opts     DoHOptions
+	servers  map[netaddr.IP]dohServer
+	strategy dohSelectionStrategy
+}
+
+// parseDoHOptions checks opts and parses it into a dohConfig.
+func parseDoHOptions(opts DoHOptions) (dohConfig, error) {
+	c := dohConfig{opts: opts}
+	if err := opts.QueryID.Validate(); err != nil {
+		return c, err
+	}
+	if n := opts.MaxResponseBytes; n != 0 && n < headerBytes {
+		return c, fmt.Errorf("DoH MaxResponseBytes %d is too small for a DNS message", n)
+	}
+	var err error
+	if c.strategy, err = newDoHSelectionStrategy(opts.Selection); err != nil {
+		return c, err
+	}
+	for _, s := range opts.Servers {
+		srv, err := parseDoHServer(s)
+		if err != nil {
+			return c, err
+		}
+		if c.servers == nil {
+			c.servers = map[netaddr.IP]dohServer{}
+		}
+		c.servers[srv.ip] = srv
+	}
+	return c, nil
+}
+
+// setDoHOptions makes f use opts for queries from now on. If opts is
+// invalid, it returns an error and f is unchanged.
+func (f *forwarder) setDoHOptions(opts DoHOptions) error {
+	c, err := parseDoHOptions(opts)
+	if err != nil {
+		return err
+	}
+	f.applyDoHConfig(c)
+	return nil
+}
+
+// applyDoHConfig makes f use c for queries from now on.
+func (f *forwarder) applyDoHConfig(c dohConfig) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.dohServers = c.servers
+	if c.opts.Selection != f.dohOpts.Selection {
+		// Otherwise keep the old strategy and its state, such as
+		// whose turn it is for round-robin.
+		f.dohStrategy = c.strategy
+	}
+	if c.opts.MaxInflight != f.dohOpts.MaxInflight {
+		f.dohSem = nil
+	}
+	f.dohOpts = c.opts
+}
+
+// setUDPQueryID makes f choose the DNS ID of queries sent over plain
+// UDP per s, which must be valid, from now on.
+func (f *forwarder) setUDPQueryID(s QueryIDStrategy) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.udpQueryID = s
+}
+
+func (f *forwarder) udpQueryIDStrategy() QueryIDStrategy {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.udpQueryID
+}
+
+// dohOptions returns the DoHOptions currently in use by f.
+func (f *forwarder) dohOptions() DoHOptions {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.dohOpts
+}
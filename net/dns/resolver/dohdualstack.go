@@ -0,0 +1,133 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package resolver
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	dns "golang.org/x/net/dns/dnsmessage"
+	"inet.af/netaddr"
+	"tailscale.com/util/dnsname"
+)
+
+// DualStackResult is the result of Resolver.LookupDualStack. The A
+// and AAAA lookups succeed or fail independently, so either may have
+// answers while the other has an error.
+type DualStackResult struct {
+	A    []netaddr.IP // IPv4 addresses from the A query
+	AErr error        // error from the A query, if any
+
+	AAAA    []netaddr.IP // IPv6 addresses from the AAAA query
+	AAAAErr error        // error from the AAAA query, if any
+}
+
+// LookupDualStack looks up both the A and AAAA records of name using
+// DNS-over-HTTPS, sending the two queries concurrently so that a
+// dual-stack lookup takes one round trip rather than two.
+//
+// The queries go to the preferred DoH-capable upstream resolver that
+// name is routed to; local records aren't consulted. It returns an
+// error if there's no such resolver.
+func (r *Resolver) LookupDualStack(ctx context.Context, name dnsname.FQDN) (DualStackResult, error) {
+	return r.forwarder.lookupDualStackRouted(ctx, name)
+}
+
+// lookupDualStackRouted is LookupDualStack for f.
+func (f *forwarder) lookupDualStackRouted(ctx context.Context, name dnsname.FQDN) (DualStackResult, error) {
+	parallel, doh := f.orderDoH(f.resolvers(name))
+	for _, ipp := range append(doh, parallel...) {
+		if srv, c, ok := f.getDoHClient(ipp.IP()); ok {
+			return f.lookupDualStack(ctx, ipp, srv, c, name), nil
+		}
+	}
+	return DualStackResult{}, fmt.Errorf("no DNS-over-HTTPS resolver for %v", name)
+}
+
+// lookupDualStack looks up both the A and AAAA records of name on the
+// DoH server srv standing in for dst, sending the two queries
+// concurrently using c.
+//
+// A truncated answer is retried over TCP to dst. If that fails, the
+// truncated answer's addresses are returned without an error.
+func (f *forwarder) lookupDualStack(ctx context.Context, dst netaddr.IPPort, srv dohServer, c *http.Client, name dnsname.FQDN) DualStackResult {
+	type answer struct {
+		ips []netaddr.IP
+		err error
+	}
+	lookup := func(typ dns.Type, ansc chan<- answer) {
+		ips, err := f.lookupDoH(ctx, dst, srv, c, name, typ)
+		ansc <- answer{ips, err}
+	}
+	ac, aaaac := make(chan answer, 1), make(chan answer, 1)
+	go lookup(dns.TypeA, ac)
+	go lookup(dns.TypeAAAA, aaaac)
+	a, aaaa := <-ac, <-aaaac
+	return DualStackResult{A: a.ips, AErr: a.err, AAAA: aaaa.ips, AAAAErr: aaaa.err}
+}
+
+// lookupDoH queries the DoH server srv standing in for dst for the typ
+// records of name, which must be dns.TypeA or dns.TypeAAAA, and
+// returns the addresses in the answer.
+func (f *forwarder) lookupDoH(ctx context.Context, dst netaddr.IPPort, srv dohServer, c *http.Client, name dnsname.FQDN, typ dns.Type) ([]netaddr.IP, error) {
+	qname, err := dns.NewName(name.WithTrailingDot())
+	if err != nil {
+		return nil, err
+	}
+	b := dns.NewBuilder(nil, dns.Header{RecursionDesired: true})
+	b.StartQuestions()
+	b.Question(dns.Question{Name: qname, Type: typ, Class: dns.ClassINET})
+	query, err := b.Finish()
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := f.sendDoHTo(ctx, srv, c, query, dst)
+	if err != nil {
+		return nil, err
+	}
+
+	var p dns.Parser
+	h, err := p.Start(res)
+	if err != nil {
+		return nil, err
+	}
+	if h.RCode != dns.RCodeSuccess {
+		return nil, fmt.Errorf("%v lookup of %v: %v", typ, name, h.RCode)
+	}
+	if err := p.SkipAllQuestions(); err != nil {
+		return nil, err
+	}
+	var ips []netaddr.IP
+	for {
+		ah, err := p.AnswerHeader()
+		if err == dns.ErrSectionDone {
+			return ips, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case ah.Type == dns.TypeA && typ == dns.TypeA:
+			r, err := p.AResource()
+			if err != nil {
+				return nil, err
+			}
+			ips = append(ips, netaddr.IPv4(r.A[0], r.A[1], r.A[2], r.A[3]))
+		case ah.Type == dns.TypeAAAA && typ == dns.TypeAAAA:
+			r, err := p.AAAAResource()
+			if err != nil {
+				return nil, err
+			}
+			ips = append(ips, netaddr.IPFrom16(r.AAAA))
+		default:
+			// CNAMEs and such; the addresses follow.
+			if err := p.SkipAnswer(); err != nil {
+				return nil, err
+			}
+		}
+	}
+}
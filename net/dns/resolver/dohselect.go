@@ -0,0 +1,222 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package resolver
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"sync/atomic"
+	"time"
+
+	"inet.af/netaddr"
+)
+
+// dohCandidate is a DoH-capable upstream resolver that a query may
+// be sent to, along with what's been observed about it recently.
+type dohCandidate struct {
+	ipp netaddr.IPPort
+	// rtt is the smoothed round trip time of recent successful
+	// DoH queries to ipp, or zero if there haven't been any.
+	rtt time.Duration
+}
+
+// dohSelectionStrategy chooses the order in which a query tries the
+// DoH-capable resolvers configured for it.
+type dohSelectionStrategy interface {
+	// Order returns cands sorted by preference, most preferred
+	// first. It may reorder cands in place.
+	Order(cands []dohCandidate) []dohCandidate
+}
+
+// dohRoundRobin is a dohSelectionStrategy that rotates through the
+// candidates, preferring the next one in line for each query.
+type dohRoundRobin struct {
+	next uint32 // atomic
+}
+
+func (r *dohRoundRobin) Order(cands []dohCandidate) []dohCandidate {
+	if len(cands) < 2 {
+		return cands
+	}
+	k := int((atomic.AddUint32(&r.next, 1) - 1) % uint32(len(cands)))
+	return append(append(make([]dohCandidate, 0, len(cands)), cands[k:]...), cands[:k]...)
+}
+
+// dohLatencyWeighted is a dohSelectionStrategy that prefers
+// candidates at random, each with a probability inversely
+// proportional to its observed RTT. Faster resolvers get most of the
+// queries while slower ones still get enough to notice if they
+// speed up.
+//
+// Candidates without an RTT yet are weighted as if they were as fast
+// as the fastest one, so new resolvers get measured.
+type dohLatencyWeighted struct {
+	// rand, if non-nil, returns a pseudo-random number in [0, 1).
+	// If nil, math/rand's Float64 is used.
+	rand func() float64
+}
+
+func (l dohLatencyWeighted) Order(cands []dohCandidate) []dohCandidate {
+	if len(cands) < 2 {
+		return cands
+	}
+	rnd := l.rand
+	if rnd == nil {
+		rnd = rand.Float64
+	}
+	var fastest time.Duration
+	for _, c := range cands {
+		if c.rtt > 0 && (fastest == 0 || c.rtt < fastest) {
+			fastest = c.rtt
+		}
+	}
+	if fastest == 0 {
+		fastest = time.Millisecond // nothing measured; weigh all equally
+	}
+	weight := func(c dohCandidate) float64 {
+		if c.rtt <= 0 {
+			return 1 / float64(fastest)
+		}
+		return 1 / float64(c.rtt)
+	}
+
+	// Pick without replacement, moving each pick to the front of
+	// what's left.
+	for i := 0; i < len(cands)-1; i++ {
+		var total float64
+		for _, c := range cands[i:] {
+			total += weight(c)
+		}
+		x := rnd() * total
+		j := i
+		for ; j < len(cands)-1; j++ {
+			x -= weight(cands[j])
+			if x < 0 {
+				break
+			}
+		}
+		cands[i], cands[j] = cands[j], cands[i]
+	}
+	return cands
+}
+
+// observeDoHRTT records d as the time taken by a successful DoH
+// query to ip.
+func (f *forwarder) observeDoHRTT(ip netaddr.IP, d time.Duration) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.dohRTT == nil {
+		f.dohRTT = map[netaddr.IP]time.Duration{}
+	}
+	if old, ok := f.dohRTT[ip]; ok {
+		d = old - old/8 + d/8 // smoothed like TCP's SRTT
+	}
+	f.dohRTT[ip] = d
+}
+
+// newDoHSelectionStrategy returns the strategy named by s, or nil if
+// s is empty.
+func newDoHSelectionStrategy(s DoHSelection) (dohSelectionStrategy, error) {
+	switch s {
+	case "":
+		return nil, nil
+	case DoHSelectRoundRobin:
+		return new(dohRoundRobin), nil
+	case DoHSelectLatencyWeighted:
+		return dohLatencyWeighted{}, nil
+	}
+	return nil, fmt.Errorf("unknown DoH selection strategy %q", s)
+}
+
+// orderDoH splits resolvers into those to query in parallel as usual
+// and, if f has a dohStrategy, the DoH-capable ones to instead try
+// one at a time in the strategy's order of preference.
+//
+// Resolvers that plain UDP won a race against (per DoHOptions.Race)
+// are queried in parallel, as they won't be sent DoH anyway.
+func (f *forwarder) orderDoH(resolvers []netaddr.IPPort) (parallel, doh []netaddr.IPPort) {
+	f.mu.Lock()
+	strategy := f.dohStrategy
+	if strategy == nil {
+		f.mu.Unlock()
+		return resolvers, nil
+	}
+	var cands []dohCandidate
+	for _, ipp := range resolvers {
+		_, ok := f.dohServerLocked(ipp.IP())
+		if r, raced := f.dohRaces[ipp.IP()]; ok && f.dohOpts.Race && raced && r.udpWon && time.Since(r.at) <= dohRaceTTL {
+			ok = false
+		}
+		if ok {
+			cands = append(cands, dohCandidate{ipp: ipp, rtt: f.dohRTT[ipp.IP()]})
+		} else {
+			parallel = append(parallel, ipp)
+		}
+	}
+	f.mu.Unlock()
+	for _, c := range strategy.Order(cands) {
+		doh = append(doh, c.ipp)
+	}
+	return parallel, doh
+}
+
+// dohHedgeDelay is the default for DoHOptions.HedgeDelay.
+const dohHedgeDelay = 500 * time.Millisecond
+
+func (f *forwarder) dohHedgeDelay() time.Duration {
+	if d := f.dohOptions().HedgeDelay; d > 0 {
+		return d
+	}
+	return dohHedgeDelay
+}
+
+// tryInOrder calls try for each of cands in turn until one reports
+// success, and reports whether any did.
+//
+// A candidate that hasn't finished within hedgeDelay isn't given up
+// on, but the next one is started alongside it, so that a black-holed
+// resolver can't use up all of a query's time. No more candidates are
+// started once ctx is done.
+func tryInOrder(ctx context.Context, cands []netaddr.IPPort, hedgeDelay time.Duration, try func(netaddr.IPPort) bool) bool {
+	resc := make(chan bool, len(cands))
+	next, pending := 0, 0
+	start := func() {
+		ipp := cands[next]
+		next++
+		pending++
+		go func() { resc <- try(ipp) }()
+	}
+	hedge := time.NewTimer(hedgeDelay)
+	defer hedge.Stop()
+	for next < len(cands) || pending > 0 {
+		if pending == 0 {
+			start()
+		}
+		var hedgec <-chan time.Time
+		if next < len(cands) {
+			if !hedge.Stop() {
+				select {
+				case <-hedge.C:
+				default:
+				}
+			}
+			hedge.Reset(hedgeDelay)
+			hedgec = hedge.C
+		}
+		select {
+		case ok := <-resc:
+			pending--
+			if ok {
+				return true
+			}
+		case <-hedgec:
+			start()
+		case <-ctx.Done():
+			return false
+		}
+	}
+	return false
+}
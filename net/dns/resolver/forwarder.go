@@ -7,22 +7,32 @@ package resolver
 import (
 	"bytes"
 	"context"
+	crand "crypto/rand"
+	"encoding/base64"
 	"encoding/binary"
 	"errors"
+	"expvar"
 	"fmt"
 	"hash/crc32"
 	"io"
 	"io/ioutil"
 	"math/rand"
+	"mime"
 	"net"
 	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
 
 	dns "golang.org/x/net/dns/dnsmessage"
 	"inet.af/netaddr"
+	"tailscale.com/metrics"
+	"tailscale.com/net/interfaces"
 	"tailscale.com/net/netns"
+	"tailscale.com/syncs"
 	"tailscale.com/types/logger"
 	"tailscale.com/util/dnsname"
 	"tailscale.com/wgengine/monitor"
@@ -31,6 +41,9 @@ import (
 // headerBytes is the number of bytes in a DNS message header.
 const headerBytes = 12
 
+// dnsFlagTruncated is the TC bit in the flags field of a DNS message header.
+const dnsFlagTruncated = 0x200
+
 const (
 	// responseTimeout is the maximal amount of time to wait for a DNS response.
 	responseTimeout = 5 * time.Second
@@ -39,9 +52,22 @@ const (
 	// connections open to DNS-over-HTTPs servers. This is pretty
 	// arbitrary.
 	dohTransportTimeout = 30 * time.Second
+
+	// dohDefaultMaxResponseBytes is the default limit on the size
+	// of a DoH response body. It's larger than any DNS message can
+	// be, so only a broken or malicious server would exceed it.
+	dohDefaultMaxResponseBytes = 64 << 10
 )
 
-var errNoUpstreams = errors.New("upstream nameservers not set")
+var (
+	errNoUpstreams         = errors.New("upstream nameservers not set")
+	errDoHResponseTooLarge = errors.New("DoH response too large")
+	errDoHBusy             = errors.New("too many DoH queries in flight")
+
+	// errDoHTruncated is returned by sendDoH, along with the
+	// response, when the response has the TC bit set.
+	errDoHTruncated = errors.New("DoH response truncated")
+)
 
 // txid identifies a DNS transaction.
 //
@@ -163,12 +189,53 @@ type forwarder struct {
 	ctx       context.Context    // good until Close
 	ctxCancel context.CancelFunc // closes ctx
 
+	unregisterLinkChange func() // or nil
+
 	// responses is a channel by which responses are returned.
 	responses chan packet
 
+	// dohConnReused and dohConnNew count DoH requests that were
+	// sent on a pooled connection versus a newly dialed one.
+	// They're exported by expVar.
+	dohConnReused expvar.Int
+	dohConnNew    expvar.Int
+
 	mu sync.Mutex // guards following
 
-	dohClient map[netaddr.IP]*http.Client
+	dohOpts    DoHOptions
+	udpQueryID QueryIDStrategy
+
+	// dohStrategy, if non-nil, picks which of a query's DoH-capable
+	// resolvers to use, trying them one at a time in its order of
+	// preference, rather than sending to them all at once. It's
+	// set from dohOpts.Selection.
+	dohStrategy dohSelectionStrategy
+
+	dohClient map[netaddr.IPPort]*http.Client // keyed by dohServer ip and port
+
+	// inflightIDs are the upstream DNS IDs in use by in-flight
+	// queries sent with QueryIDRandom.
+	inflightIDs map[uint16]bool
+
+	// dohRaces records, for each resolver raced per DoHOptions.Race,
+	// how the race went. It's cleared when the link changes.
+	dohRaces map[netaddr.IP]dohRace
+
+	// dohCalls are the in-flight DoH queries that identical
+	// queries can share. See sendDoHShared.
+	dohCalls map[dohKey]*dohCall
+
+	// dohSem limits the in-flight queries to each DoH server IP
+	// when dohOpts.MaxInflight is set. It's reset when that changes.
+	dohSem map[netaddr.IP]syncs.Semaphore
+
+	// dohServers are the DoH servers from dohOpts.Servers, which
+	// take precedence over knownDoH.
+	dohServers map[netaddr.IP]dohServer
+
+	// dohRTT is the smoothed RTT of successful DoH queries to
+	// each resolver, for dohStrategy.
+	dohRTT map[netaddr.IP]time.Duration
 
 	// routes are per-suffix resolvers to use, with
 	// the most specific routes first.
@@ -187,14 +254,40 @@ func newForwarder(logf logger.Logf, responses chan packet, linkMon *monitor.Mon,
 		responses: responses,
 	}
 	f.ctx, f.ctxCancel = context.WithCancel(context.Background())
+	if linkMon != nil {
+		f.unregisterLinkChange = linkMon.RegisterChangeCallback(f.linkChange)
+	}
 	return f
 }
 
 func (f *forwarder) Close() error {
+	if f.unregisterLinkChange != nil {
+		f.unregisterLinkChange()
+	}
 	f.ctxCancel()
 	return nil
 }
 
+// linkChange is called by the link monitor when the network changes.
+func (f *forwarder) linkChange(changed bool, st *interfaces.State) {
+	if !changed {
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	// Which transport is faster depends on the network, so race
+	// again on the new one.
+	f.dohRaces = nil
+}
+
+// expVar returns f's metrics, for Resolver.ExpVar.
+func (f *forwarder) expVar() expvar.Var {
+	m := new(metrics.Set)
+	m.Set("doh_requests_reused_conn", &f.dohConnReused)
+	m.Set("doh_requests_new_conn", &f.dohConnNew)
+	return m
+}
+
 func (f *forwarder) setRoutes(routes []route) {
 	f.mu.Lock()
 	defer f.mu.Unlock()
@@ -222,18 +315,50 @@ func (f *forwarder) packetListener(ip netaddr.IP) (packetListener, error) {
 	return lc, nil
 }
 
-func (f *forwarder) getDoHClient(ip netaddr.IP) (urlBase string, c *http.Client, ok bool) {
-	urlBase, ok = knownDoH[ip]
-	if !ok {
-		return
+// tcpDialer returns the dialer to use for plain DNS over TCP to ip.
+// Like packetListener, it binds to the link that f.linkSel picks for
+// ip, so that a TCP retry leaves the same way as the UDP query.
+func (f *forwarder) tcpDialer(ip netaddr.IP) (netns.Dialer, error) {
+	if f.linkSel == nil || initListenConfig == nil {
+		return netns.NewDialer(), nil
+	}
+	linkName := f.linkSel.PickLink(ip)
+	if linkName == "" {
+		return netns.NewDialer(), nil
 	}
+	lc := new(net.ListenConfig)
+	if err := initListenConfig(lc, f.linkMon, linkName); err != nil {
+		return nil, err
+	}
+	return &net.Dialer{Control: lc.Control}, nil
+}
+
+// dohServerLocked returns the DoH server to use in place of the plain
+// DNS resolver ip, if any: the one configured in DoHOptions.Servers, or
+// else the well-known one.
+//
+// f.mu must be held.
+func (f *forwarder) dohServerLocked(ip netaddr.IP) (_ dohServer, ok bool) {
+	if srv, ok := f.dohServers[ip]; ok {
+		return srv, true
+	}
+	srv, ok := knownDoH[ip]
+	return srv, ok
+}
+
+func (f *forwarder) getDoHClient(ip netaddr.IP) (srv dohServer, c *http.Client, ok bool) {
 	f.mu.Lock()
 	defer f.mu.Unlock()
-	if c, ok := f.dohClient[ip]; ok {
-		return urlBase, c, true
+	srv, ok = f.dohServerLocked(ip)
+	if !ok {
+		return
+	}
+	dialAddr := netaddr.IPPortFrom(ip, srv.port)
+	if c, ok := f.dohClient[dialAddr]; ok {
+		return srv, c, true
 	}
 	if f.dohClient == nil {
-		f.dohClient = map[netaddr.IP]*http.Client{}
+		f.dohClient = map[netaddr.IPPort]*http.Client{}
 	}
 	nsDialer := netns.NewDialer()
 	c = &http.Client{
@@ -243,27 +368,291 @@ func (f *forwarder) getDoHClient(ip netaddr.IP) (urlBase string, c *http.Client,
 				if !strings.HasPrefix(netw, "tcp") {
 					return nil, fmt.Errorf("unexpected network %q", netw)
 				}
-				return nsDialer.DialContext(ctx, "tcp", net.JoinHostPort(ip.String(), "443"))
+				return nsDialer.DialContext(ctx, "tcp", dialAddr.String())
 			},
 		},
 	}
-	f.dohClient[ip] = c
-	return urlBase, c, true
+	f.dohClient[dialAddr] = c
+	return srv, c, true
 }
 
 const dohType = "application/dns-message"
 
-func (f *forwarder) sendDoH(ctx context.Context, urlBase string, c *http.Client, packet []byte) ([]byte, error) {
-	req, err := http.NewRequestWithContext(ctx, "POST", urlBase, bytes.NewReader(packet))
+// dohServer describes how to talk to a DoH server.
+type dohServer struct {
+	// ip is the IP of the plain DNS resolver that the DoH server
+	// stands in for, and that its connections go to.
+	ip netaddr.IP
+	// port is the port its connections go to: that of its URL,
+	// or else 443.
+	port uint16
+
+	// urlTemplate is the server's URL template, including its
+	// full path. See expandDoHTemplate.
+	urlTemplate string
+
+	// contentType is the media type of queries and responses.
+	// If empty, dohType is used.
+	contentType string
+
+	// accept, if non-empty, is sent as the Accept header.
+	accept string
+}
+
+// parseDoHServer returns the dohServer that s describes, after
+// checking that it has an IP, that its URL template expands to an
+// absolute https URL, and that its media types are well-formed.
+func parseDoHServer(s DoHServer) (dohServer, error) {
+	if s.IP.IsZero() {
+		return dohServer{}, fmt.Errorf("DoH server %q has no IP", s.URLTemplate)
+	}
+	u, _, err := expandDoHTemplate(s.URLTemplate, nil)
+	if err != nil {
+		return dohServer{}, err
+	}
+	pu, err := url.Parse(u)
+	if err != nil {
+		return dohServer{}, err
+	}
+	if pu.Scheme != "https" || pu.Host == "" {
+		return dohServer{}, fmt.Errorf("DoH URL %q is not an absolute https URL", s.URLTemplate)
+	}
+	port := uint16(443)
+	if p := pu.Port(); p != "" {
+		n, err := strconv.ParseUint(p, 10, 16)
+		if err != nil || n == 0 {
+			return dohServer{}, fmt.Errorf("DoH URL %q has a bad port", s.URLTemplate)
+		}
+		port = uint16(n)
+	}
+	if s.ContentType != "" {
+		if _, _, err := mime.ParseMediaType(s.ContentType); err != nil {
+			return dohServer{}, fmt.Errorf("DoH server %q: bad content type %q: %v", s.URLTemplate, s.ContentType, err)
+		}
+	}
+	if strings.ContainsAny(s.Accept, "\r\n") {
+		return dohServer{}, fmt.Errorf("DoH server %q: bad Accept header %q", s.URLTemplate, s.Accept)
+	}
+	return dohServer{
+		ip:          s.IP,
+		port:        port,
+		urlTemplate: s.URLTemplate,
+		contentType: s.ContentType,
+		accept:      s.Accept,
+	}, nil
+}
+
+func (s dohServer) mediaType() string {
+	if s.contentType != "" {
+		return s.contentType
+	}
+	return dohType
+}
+
+// dohSemaphore returns the semaphore limiting in-flight queries to
+// srv, if f has a DoHOptions.MaxInflight limit, and whether queries
+// over the limit should fail rather than wait.
+//
+// The limit is per server IP rather than per provider: each IP has
+// its own connection pool (see getDoHClient), and a provider's IPs
+// are usually separate anycast frontends, so sharing one limit among,
+// say, all of Cloudflare's would only throttle queries needlessly.
+func (f *forwarder) dohSemaphore(srv dohServer) (_ syncs.Semaphore, failFast, ok bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.dohOpts.MaxInflight <= 0 {
+		return syncs.Semaphore{}, false, false
+	}
+	sem, ok := f.dohSem[srv.ip]
+	if !ok {
+		if f.dohSem == nil {
+			f.dohSem = map[netaddr.IP]syncs.Semaphore{}
+		}
+		sem = syncs.NewSemaphore(f.dohOpts.MaxInflight)
+		f.dohSem[srv.ip] = sem
+	}
+	return sem, f.dohOpts.FailFast, true
+}
+
+// setQueryID returns packet with its DNS ID chosen per strategy s,
+// along with the client's original ID and a func to call once the
+// query is done. Unless s is QueryIDPassthrough, in which case packet
+// is returned as is, the returned packet is a copy.
+func (f *forwarder) setQueryID(s QueryIDStrategy, packet []byte) (out []byte, origID uint16, done func()) {
+	if s == QueryIDPassthrough || len(packet) < headerBytes {
+		return packet, 0, func() {}
+	}
+	origID = binary.BigEndian.Uint16(packet[0:2])
+	out = append([]byte(nil), packet...)
+	var id uint16
+	done = func() {}
+	if s == QueryIDRandom {
+		var reserved bool
+		id, reserved = f.allocID()
+		if reserved {
+			done = func() { f.releaseID(id) }
+		}
+	}
+	binary.BigEndian.PutUint16(out[0:2], id)
+	return out, origID, done
+}
+
+// allocID returns a random DNS ID that no other in-flight query is
+// using and marks it as in use until releaseID.
+//
+// If every ID is in flight, which maxActiveQueries should make
+// impossible, allocID returns a random one without reserving it, and
+// reserved is false: the caller shares the ID and mustn't release it.
+//
+// The IDs come from crypto/rand, as their point is that an off-path
+// attacker can't guess them.
+func (f *forwarder) allocID() (id uint16, reserved bool) {
+	var b [2]byte
+	if _, err := crand.Read(b[:]); err != nil {
+		panic(fmt.Sprintf("crypto/rand: %v", err))
+	}
+	start := int(binary.BigEndian.Uint16(b[:]))
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.inflightIDs == nil {
+		f.inflightIDs = map[uint16]bool{}
+	}
+	for i := 0; i < 1<<16; i++ {
+		id := uint16(start + i)
+		if !f.inflightIDs[id] {
+			f.inflightIDs[id] = true
+			return id, true
+		}
+	}
+	return uint16(start), false
+}
+
+func (f *forwarder) releaseID(id uint16) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.inflightIDs, id)
+}
+
+func (f *forwarder) maxDoHResponseBytes() int {
+	if n := f.dohOptions().MaxResponseBytes; n != 0 {
+		return n
+	}
+	return dohDefaultMaxResponseBytes
+}
+
+// expandDoHTemplate expands tmpl, an RFC 6570 URI template of the
+// sort RFC 8484 uses to describe DoH servers, with packet as the
+// value of its "dns" variable, base64url-encoded without padding.
+//
+// Only simple string expansion ("{dns}") and form-style query
+// expansion ("{?dns}" and "{&dns}") are supported, which covers the
+// templates DoH providers publish. Variables other than "dns" are
+// undefined and expand to nothing. It reports whether the template
+// used the dns variable, in which case the query should be sent with
+// GET rather than POST.
+func expandDoHTemplate(tmpl string, packet []byte) (u string, usesDNS bool, err error) {
+	var sb strings.Builder
+	for {
+		i := strings.IndexByte(tmpl, '{')
+		if i == -1 {
+			sb.WriteString(tmpl)
+			return sb.String(), usesDNS, nil
+		}
+		sb.WriteString(tmpl[:i])
+		j := strings.IndexByte(tmpl[i:], '}')
+		if j == -1 {
+			return "", false, fmt.Errorf("unterminated expression in DoH URL template %q", tmpl)
+		}
+		expr := tmpl[i+1 : i+j]
+		tmpl = tmpl[i+j+1:]
+
+		var op byte
+		if expr != "" && (expr[0] == '?' || expr[0] == '&') {
+			op, expr = expr[0], expr[1:]
+		} else if expr == "" || strings.ContainsAny(expr[:1], "+#./;=,!@|") {
+			return "", false, fmt.Errorf("unsupported expression {%s} in DoH URL template", expr)
+		}
+		for _, name := range strings.Split(expr, ",") {
+			if name != "dns" {
+				continue // undefined
+			}
+			val := base64.RawURLEncoding.EncodeToString(packet)
+			switch op {
+			case 0:
+				sb.WriteString(val)
+			default:
+				sb.WriteByte(op)
+				op = '&' // for any later variables in this expression
+				sb.WriteString("dns=")
+				sb.WriteString(val)
+			}
+			usesDNS = true
+		}
+	}
+}
+
+// sendDoH sends packet to the DoH server srv using c. Templates
+// without a dns variable are sent the query as a POST body.
+//
+// If the response has the TC bit set, sendDoH returns it along with
+// errDoHTruncated, so the caller can decide whether the partial
+// answer is good enough or whether to retry another way.
+func (f *forwarder) sendDoH(ctx context.Context, srv dohServer, c *http.Client, packet []byte) ([]byte, error) {
+	if sem, failFast, ok := f.dohSemaphore(srv); ok {
+		if failFast {
+			if !sem.TryAcquire() {
+				return nil, errDoHBusy
+			}
+		} else if !sem.AcquireContext(ctx) {
+			return nil, ctx.Err()
+		}
+		defer sem.Release()
+	}
+
+	// conn is the connection the request went out on, so that it
+	// can be closed rather than returned to the pool if the
+	// response shows the server speaking something other than DoH.
+	var conn net.Conn
+	ctx = httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			conn = info.Conn
+			if info.Reused {
+				f.dohConnReused.Add(1)
+			} else {
+				f.dohConnNew.Add(1)
+			}
+		},
+	})
+
+	idStrategy := f.dohOptions().QueryID
+	packet, origID, done := f.setQueryID(idStrategy, packet)
+	defer done()
+
+	u, useGET, err := expandDoHTemplate(srv.urlTemplate, packet)
+	if err != nil {
+		return nil, err
+	}
+	var req *http.Request
+	if useGET {
+		req, err = http.NewRequestWithContext(ctx, "GET", u, nil)
+	} else {
+		req, err = http.NewRequestWithContext(ctx, "POST", u, bytes.NewReader(packet))
+	}
 	if err != nil {
 		return nil, err
 	}
-	req.Header.Set("Content-Type", dohType)
-	// Note: we don't currently set the Accept header (which is
+	if !useGET {
+		req.Header.Set("Content-Type", srv.mediaType())
+	}
+	// Note: by default we don't set the Accept header (which is
 	// only a SHOULD in the spec) as iOS doesn't use HTTP/2 and
 	// we'd rather save a few bytes on outgoing requests when
 	// empirically no provider cares about the Accept header's
-	// absence.
+	// absence. Servers that do care can have one configured.
+	if srv.accept != "" {
+		req.Header.Set("Accept", srv.accept)
+	}
 
 	hres, err := c.Do(req)
 	if err != nil {
@@ -273,10 +662,153 @@ func (f *forwarder) sendDoH(ctx context.Context, urlBase string, c *http.Client,
 	if hres.StatusCode != 200 {
 		return nil, errors.New(hres.Status)
 	}
-	if ct := hres.Header.Get("Content-Type"); ct != dohType {
+	if ct := hres.Header.Get("Content-Type"); ct != srv.mediaType() {
+		closeDoHConn(hres, conn)
 		return nil, fmt.Errorf("unexpected response Content-Type %q", ct)
 	}
-	return ioutil.ReadAll(hres.Body)
+	max := f.maxDoHResponseBytes()
+	res, err := ioutil.ReadAll(io.LimitReader(hres.Body, int64(max)+1))
+	if err != nil {
+		closeDoHConn(hres, conn)
+		return nil, err
+	}
+	if len(res) > max {
+		return nil, errDoHResponseTooLarge
+	}
+	if idStrategy != QueryIDPassthrough && len(packet) >= headerBytes {
+		if len(res) < headerBytes || !bytes.Equal(res[0:2], packet[0:2]) {
+			closeDoHConn(hres, conn)
+			return nil, errors.New("DoH response DNS ID doesn't match query")
+		}
+		binary.BigEndian.PutUint16(res[0:2], origID)
+	}
+	if len(res) >= headerBytes && binary.BigEndian.Uint16(res[2:4])&dnsFlagTruncated != 0 {
+		return res, errDoHTruncated
+	}
+	return res, nil
+}
+
+// dohKey identifies a DoH query for sharing by sendDoHShared.
+//
+// It's keyed on the server IP rather than its URL template because
+// several IPs commonly share a template (1.1.1.1 and 1.0.0.1, say),
+// and a query sent to each of them mustn't end up waiting on just
+// the one that got there first, which may not be reachable.
+//
+// Everything in the query but its ID is part of the key, not just
+// its question: header flags such as CD and EDNS options such as the
+// DO bit change the answer, so a query mustn't be given an answer
+// that was asked for differently.
+type dohKey struct {
+	ip    netaddr.IP // dohServer.ip
+	query string     // the query packet, minus its DNS ID
+}
+
+// dohCall is an in-flight DoH query shared by sendDoHShared.
+type dohCall struct {
+	done chan struct{} // closed when res and err are set
+	res  []byte
+	err  error
+
+	cancel context.CancelFunc // cancels the upstream query
+
+	// waiters is the number of callers waiting for res.
+	// It's guarded by forwarder.mu.
+	waiters int
+}
+
+// dohQueryKey returns the key of the single-question query packet
+// sent to srv.
+func dohQueryKey(srv dohServer, packet []byte) (k dohKey, ok bool) {
+	var p dns.Parser
+	if _, err := p.Start(packet); err != nil {
+		return k, false
+	}
+	if _, err := p.Question(); err != nil {
+		return k, false
+	}
+	if _, err := p.Question(); err != dns.ErrSectionDone {
+		return k, false
+	}
+	return dohKey{srv.ip, string(packet[2:])}, true
+}
+
+// sendDoHShared is like sendDoH, but queries identical, other than
+// their DNS ID, to one already in flight to srv's IP wait for and
+// share its answer, with their own DNS ID put back in, rather than
+// going upstream again. See dohKey.
+//
+// The shared query doesn't belong to any one caller: it runs on its
+// own context, derived from f.ctx with a timeout of responseTimeout,
+// and each caller gives up waiting for it when its own ctx is done.
+// Only once every caller has given up is the query canceled.
+func (f *forwarder) sendDoHShared(ctx context.Context, srv dohServer, c *http.Client, packet []byte) ([]byte, error) {
+	k, ok := dohQueryKey(srv, packet)
+	if !ok {
+		return f.sendDoH(ctx, srv, c, packet)
+	}
+	f.mu.Lock()
+	call, ok := f.dohCalls[k]
+	if !ok {
+		var callCtx context.Context
+		call = &dohCall{done: make(chan struct{})}
+		callCtx, call.cancel = context.WithTimeout(f.ctx, responseTimeout)
+		if f.dohCalls == nil {
+			f.dohCalls = map[dohKey]*dohCall{}
+		}
+		f.dohCalls[k] = call
+		go f.runDoHCall(callCtx, k, call, srv, c, append([]byte(nil), packet...))
+	}
+	call.waiters++
+	f.mu.Unlock()
+
+	select {
+	case <-call.done:
+	case <-ctx.Done():
+		f.mu.Lock()
+		call.waiters--
+		if call.waiters == 0 && f.dohCalls[k] == call {
+			// Nobody wants the answer anymore. Later queries
+			// start afresh rather than joining a canceled one.
+			delete(f.dohCalls, k)
+			call.cancel()
+		}
+		f.mu.Unlock()
+		return nil, ctx.Err()
+	}
+	if len(call.res) < headerBytes {
+		return call.res, call.err
+	}
+	res := append([]byte(nil), call.res...)
+	copy(res[0:2], packet[0:2])
+	return res, call.err
+}
+
+// runDoHCall sends the query packet for call and, once it's done,
+// wakes up call's waiters.
+func (f *forwarder) runDoHCall(ctx context.Context, k dohKey, call *dohCall, srv dohServer, c *http.Client, packet []byte) {
+	defer call.cancel()
+	call.res, call.err = f.sendDoH(ctx, srv, c, packet)
+
+	f.mu.Lock()
+	if f.dohCalls[k] == call {
+		delete(f.dohCalls, k)
+	}
+	f.mu.Unlock()
+	close(call.done)
+}
+
+// closeDoHConn closes c, if non-nil, so that an HTTP/1 connection
+// that produced the malformed DoH response res isn't reused for later
+// queries.
+//
+// HTTP/2 connections are left open: they multiplex other queries'
+// streams, which closing would fail too, and a bad response there is
+// confined to its own stream anyway.
+func closeDoHConn(res *http.Response, c net.Conn) {
+	if c != nil && res.ProtoMajor < 2 {
+		c.Close()
+	}
 }
 
 // send sends packet to dst. It is best effort.
@@ -290,12 +822,230 @@ func (f *forwarder) sendDoH(ctx context.Context, urlBase string, c *http.Client,
 // without too much associated goroutine/memory cost.
 func (f *forwarder) send(ctx context.Context, txidOut txid, closeOnCtxDone *closePool, packet []byte, dst netaddr.IPPort) ([]byte, error) {
 	// Upgrade known DNS IPs to DoH (DNS-over-HTTPs).
-	if urlBase, dc, ok := f.getDoHClient(dst.IP()); ok {
-		res, err := f.sendDoH(ctx, urlBase, dc, packet)
+	if srv, dc, ok := f.getDoHClient(dst.IP()); ok {
+		if f.dohOptions().Race {
+			udpWon, raced := f.raceResult(dst.IP())
+			if !raced {
+				return f.sendRace(ctx, txidOut, closeOnCtxDone, packet, dst, srv, dc)
+			}
+			if udpWon {
+				return f.sendUDP(ctx, txidOut, closeOnCtxDone, packet, dst)
+			}
+		}
+		res, err := f.sendDoHTo(ctx, srv, dc, packet, dst)
 		if err == nil || ctx.Err() != nil {
 			return res, err
 		}
-		f.logf("DoH error from %v: %v", dst.IP, err)
+		f.logf("DoH error from %v: %v", dst.IP(), err)
+	}
+	return f.sendUDP(ctx, txidOut, closeOnCtxDone, packet, dst)
+}
+
+// sendDoHOnly is like send, but doesn't fall back to plain DNS when
+// DoH fails, so that another DoH-capable resolver can be tried first.
+//
+// The exception is a resolver yet to be raced per DoHOptions.Race,
+// which is raced just as send would. Resolvers that plain UDP beat
+// don't get here; orderDoH queries them in parallel instead.
+func (f *forwarder) sendDoHOnly(ctx context.Context, txidOut txid, closeOnCtxDone *closePool, packet []byte, dst netaddr.IPPort) ([]byte, error) {
+	srv, dc, ok := f.getDoHClient(dst.IP())
+	if !ok {
+		return nil, fmt.Errorf("no DoH server for %v", dst.IP())
+	}
+	if f.dohOptions().Race {
+		if _, raced := f.raceResult(dst.IP()); !raced {
+			return f.sendRace(ctx, txidOut, closeOnCtxDone, packet, dst, srv, dc)
+		}
+	}
+	res, err := f.sendDoHTo(ctx, srv, dc, packet, dst)
+	if err != nil && ctx.Err() == nil {
+		f.logf("DoH error from %v: %v", dst.IP(), err)
+	}
+	return res, err
+}
+
+// sendDoHTo sends packet to srv, the DoH server standing in for dst,
+// recording its RTT for dohStrategy and retrying a truncated answer
+// over TCP.
+func (f *forwarder) sendDoHTo(ctx context.Context, srv dohServer, dc *http.Client, packet []byte, dst netaddr.IPPort) ([]byte, error) {
+	start := time.Now()
+	res, err := f.sendDoHShared(ctx, srv, dc, packet)
+	if err == nil || err == errDoHTruncated {
+		f.observeDoHRTT(dst.IP(), time.Since(start))
+	}
+	if err == errDoHTruncated {
+		return f.untruncate(ctx, res, packet, dst), nil
+	}
+	return res, err
+}
+
+// untruncate is called when a DoH query for packet got the truncated
+// answer res. DoH itself has no size limit, so the DoH server must
+// have got a truncated answer from further upstream. untruncate asks
+// dst again over plain DNS over TCP, and returns that answer if it's
+// complete and small enough to pass on to the client. Otherwise it
+// returns res, leaving the TC bit to tell the client to retry over
+// TCP itself if it cares.
+func (f *forwarder) untruncate(ctx context.Context, res, packet []byte, dst netaddr.IPPort) []byte {
+	full, err := f.sendTCP(ctx, packet, dst)
+	switch {
+	case err != nil:
+		f.logf("truncated DoH answer from %v; TCP retry failed: %v", dst.IP(), err)
+		return res
+	case len(full) > maxResponseBytes:
+		return res
+	case binary.BigEndian.Uint16(full[2:4])&dnsFlagTruncated != 0:
+		return res
+	}
+	return full
+}
+
+// sendTCP sends packet to dst over plain DNS over TCP (RFC 7766) and
+// returns the response. See tcpDialer for how it's routed.
+//
+// The query's DNS ID is chosen as for plain UDP, as it goes to the
+// same resolver unencrypted.
+func (f *forwarder) sendTCP(ctx context.Context, packet []byte, dst netaddr.IPPort) ([]byte, error) {
+	if len(packet) < headerBytes || len(packet) > 0xffff {
+		return nil, errors.New("invalid query size")
+	}
+	idStrategy := f.udpQueryIDStrategy()
+	packet, origID, done := f.setQueryID(idStrategy, packet)
+	defer done()
+
+	d, err := f.tcpDialer(dst.IP())
+	if err != nil {
+		return nil, err
+	}
+	c, err := d.DialContext(ctx, "tcp", dst.String())
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	if d, ok := ctx.Deadline(); ok {
+		c.SetDeadline(d)
+	}
+
+	msg := make([]byte, 2+len(packet))
+	binary.BigEndian.PutUint16(msg, uint16(len(packet)))
+	copy(msg[2:], packet)
+	if _, err := c.Write(msg); err != nil {
+		return nil, err
+	}
+	var n [2]byte
+	if _, err := io.ReadFull(c, n[:]); err != nil {
+		return nil, err
+	}
+	res := make([]byte, binary.BigEndian.Uint16(n[:]))
+	if _, err := io.ReadFull(c, res); err != nil {
+		return nil, err
+	}
+	if len(res) < headerBytes || !bytes.Equal(res[0:2], packet[0:2]) {
+		return nil, errors.New("TCP response DNS ID doesn't match query")
+	}
+	if idStrategy != QueryIDPassthrough {
+		binary.BigEndian.PutUint16(res[0:2], origID)
+	}
+	return res, nil
+}
+
+// dohRaceTTL is how long the outcome of a DoH race is used for
+// before racing the resolver again.
+const dohRaceTTL = 30 * time.Minute
+
+// dohRace is the outcome of a race between DoH and plain UDP.
+type dohRace struct {
+	udpWon bool
+	at     time.Time
+}
+
+// raceResult reports whether a DoH race against ip has completed
+// within dohRaceTTL, and if so whether plain UDP won it.
+func (f *forwarder) raceResult(ip netaddr.IP) (udpWon, raced bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	r, ok := f.dohRaces[ip]
+	if !ok || time.Since(r.at) > dohRaceTTL {
+		return false, false
+	}
+	return r.udpWon, true
+}
+
+func (f *forwarder) setRaceResult(ip netaddr.IP, udpWon bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.dohRaces == nil {
+		f.dohRaces = map[netaddr.IP]dohRace{}
+	}
+	f.dohRaces[ip] = dohRace{udpWon: udpWon, at: time.Now()}
+}
+
+// sendRace sends packet to dst over DoH and plain UDP concurrently,
+// returning the first successful answer and canceling the other
+// query.
+//
+// The winner is recorded for later queries to dst, but plain UDP only
+// wins if it answers while DoH is still pending. A DoH query that
+// fails outright says nothing about which transport is faster, so
+// then nothing is recorded and the next query races again.
+//
+// Concurrent first queries to the same resolver may all race; that's
+// fine, as the extra load is limited to that initial burst.
+func (f *forwarder) sendRace(ctx context.Context, txidOut txid, closeOnCtxDone *closePool, packet []byte, dst netaddr.IPPort, srv dohServer, dc *http.Client) ([]byte, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		res []byte
+		err error
+		udp bool
+	}
+	resc := make(chan result, 2)
+	go func() {
+		res, err := f.sendDoHShared(ctx, srv, dc, packet)
+		if err == errDoHTruncated {
+			// Same as the non-racing path in send.
+			res, err = f.untruncate(ctx, res, packet, dst), nil
+		}
+		resc <- result{res, err, false}
+	}()
+	go func() {
+		res, err := f.sendUDP(ctx, txidOut, closeOnCtxDone, packet, dst)
+		resc <- result{res, err, true}
+	}()
+
+	var firstErr error
+	dohFailed := false
+	for i := 0; i < 2; i++ {
+		r := <-resc
+		if r.err != nil {
+			if firstErr == nil {
+				firstErr = r.err
+			}
+			if !r.udp {
+				dohFailed = true
+			}
+			continue
+		}
+		if !dohFailed {
+			f.setRaceResult(dst.IP(), r.udp)
+			if r.udp {
+				f.logf("plain DNS to %v beat DoH; using it for now", dst.IP())
+			}
+		}
+		return r.res, nil
+	}
+	return nil, firstErr
+}
+
+// sendUDP sends packet to dst over plain UDP. See send for the
+// meaning of the parameters.
+func (f *forwarder) sendUDP(ctx context.Context, txidOut txid, closeOnCtxDone *closePool, packet []byte, dst netaddr.IPPort) ([]byte, error) {
+	idStrategy := f.udpQueryIDStrategy()
+	packet, origID, done := f.setQueryID(idStrategy, packet)
+	defer done()
+	if idStrategy != QueryIDPassthrough {
+		txidOut = getTxID(packet)
 	}
 
 	ln, err := f.packetListener(dst.IP())
@@ -344,9 +1094,11 @@ func (f *forwarder) send(ctx context.Context, txidOut txid, closeOnCtxDone *clos
 	if txid != txidOut {
 		return nil, errors.New("txid doesn't match")
 	}
+	if idStrategy != QueryIDPassthrough && len(out) >= headerBytes {
+		binary.BigEndian.PutUint16(out[0:2], origID)
+	}
 
 	if truncated {
-		const dnsFlagTruncated = 0x200
 		flags := binary.BigEndian.Uint16(out[2:4])
 		flags |= dnsFlagTruncated
 		binary.BigEndian.PutUint16(out[2:4], flags)
@@ -386,8 +1138,8 @@ func (f *forwarder) forward(query packet) error {
 	txid := getTxID(query.bs)
 	clampEDNSSize(query.bs, maxResponseBytes)
 
-	resolvers := f.resolvers(domain)
-	if len(resolvers) == 0 {
+	resolvers, dohResolvers := f.orderDoH(f.resolvers(domain))
+	if len(resolvers) == 0 && len(dohResolvers) == 0 {
 		return errNoUpstreams
 	}
 
@@ -403,22 +1155,48 @@ func (f *forwarder) forward(query packet) error {
 		firstErr error
 	)
 
+	// try sends the query to ipp using send and reports whether it
+	// got an answer.
+	try := func(ipp netaddr.IPPort, send func(netaddr.IPPort) ([]byte, error)) bool {
+		resb, err := send(ipp)
+		if err != nil {
+			mu.Lock()
+			defer mu.Unlock()
+			if firstErr == nil {
+				firstErr = err
+			}
+			return false
+		}
+		select {
+		case resc <- resb:
+		default:
+		}
+		return true
+	}
+	sendAny := func(ipp netaddr.IPPort) ([]byte, error) {
+		return f.send(ctx, txid, closeOnCtxDone, query.bs, ipp)
+	}
 	for _, ipp := range resolvers {
-		go func(ipp netaddr.IPPort) {
-			resb, err := f.send(ctx, txid, closeOnCtxDone, query.bs, ipp)
-			if err != nil {
-				mu.Lock()
-				defer mu.Unlock()
-				if firstErr == nil {
-					firstErr = err
-				}
+		go try(ipp, sendAny)
+	}
+	if len(dohResolvers) > 0 {
+		go func() {
+			sendDoH := func(ipp netaddr.IPPort) ([]byte, error) {
+				return f.sendDoHOnly(ctx, txid, closeOnCtxDone, query.bs, ipp)
+			}
+			if tryInOrder(ctx, dohResolvers, f.dohHedgeDelay(), func(ipp netaddr.IPPort) bool {
+				return try(ipp, sendDoH)
+			}) || ctx.Err() != nil {
 				return
 			}
-			select {
-			case resc <- resb:
-			default:
+			// DoH failed everywhere; fall back to plain DNS.
+			sendUDP := func(ipp netaddr.IPPort) ([]byte, error) {
+				return f.sendUDP(ctx, txid, closeOnCtxDone, query.bs, ipp)
+			}
+			for _, ipp := range dohResolvers {
+				go try(ipp, sendUDP)
 			}
-		}(ipp)
+		}()
 	}
 
 	select {
@@ -507,9 +1285,20 @@ func (p *closePool) Close() error {
 	return nil
 }
 
-var knownDoH = map[netaddr.IP]string{}
+// knownDoH maps the IPs of well-known DNS servers to their DoH
+// equivalents.
+var knownDoH = map[netaddr.IP]dohServer{}
 
-func addDoH(ip, base string) { knownDoH[netaddr.MustParseIP(ip)] = base }
+// addDoH registers urlTemplate as the DoH equivalent of ip.
+// It panics if urlTemplate is invalid. It's only for the well-known
+// servers below; others are configured with DoHOptions.Servers.
+func addDoH(ip, urlTemplate string) {
+	srv, err := parseDoHServer(DoHServer{IP: netaddr.MustParseIP(ip), URLTemplate: urlTemplate})
+	if err != nil {
+		panic(err)
+	}
+	knownDoH[srv.ip] = srv
+}
 
 func init() {
 	// Cloudflare
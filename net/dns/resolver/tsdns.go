@@ -10,6 +10,7 @@ import (
 	"bufio"
 	"encoding/hex"
 	"errors"
+	"expvar"
 	"fmt"
 	"runtime"
 	"sort"
@@ -79,6 +80,12 @@ type Config struct {
 	// LocalDomains is a list of DNS name suffixes that should not be
 	// routed to upstream resolvers.
 	LocalDomains []dnsname.FQDN
+	// DoH tunes forwarding to upstream resolvers that are upgraded
+	// to DNS-over-HTTPS.
+	DoH DoHOptions
+	// UDPQueryID is how the DNS ID of queries forwarded over plain
+	// UDP is chosen.
+	UDPQueryID QueryIDStrategy
 }
 
 // WriteToBufioWriter write a debug version of c for logs to w, omitting
@@ -201,12 +208,29 @@ func New(logf logger.Logf, linkMon *monitor.Mon, linkSel ForwardLinkSelector) *R
 	return r
 }
 
+// ExpVar returns an expvar variable suitable for registering with
+// expvar.Publish.
+func (r *Resolver) ExpVar() expvar.Var {
+	return r.forwarder.expVar()
+}
+
 func (r *Resolver) TestOnlySetHook(hook func(Config)) { r.saveConfigForTests = hook }
 
 func (r *Resolver) SetConfig(cfg Config) error {
 	if r.saveConfigForTests != nil {
 		r.saveConfigForTests(cfg)
 	}
+	// Check everything that can be wrong before changing anything,
+	// so that a bad config leaves the old one in place.
+	doh, err := parseDoHOptions(cfg.DoH)
+	if err != nil {
+		return err
+	}
+	if err := cfg.UDPQueryID.Validate(); err != nil {
+		return err
+	}
+	r.forwarder.applyDoHConfig(doh)
+	r.forwarder.setUDPQueryID(cfg.UDPQueryID)
 
 	routes := make([]route, 0, len(cfg.Routes))
 	reverse := make(map[netaddr.IP]dnsname.FQDN, len(cfg.Hosts))
@@ -5,6 +5,40 @@
 // Package deephash hashes a Go value recursively, in a predictable
 // order, without looping.
 //
+// Floating-point values (including the parts of complex numbers) are
+// hashed by value rather than by bit pattern: every NaN hashes the
+// same as every other NaN, and -0 hashes the same as +0.
+//
+// Values held in interfaces are hashed along with the identity of
+// their dynamic type. Putting a different concrete type behind an
+// interface changes the hash, even if the two values' data look the
+// same.
+//
+// time.Time values are hashed by the instant they represent, as
+// time.Time.Equal compares them, ignoring their location and
+// monotonic clock reading. That includes time.Time values in
+// unexported struct fields.
+//
+// A value's Sum depends only on the value, not on the Go version,
+// GOOS, GOARCH, int size or the process computing it, so different
+// machines can compare Sums to agree on a value. In particular,
+// integers and floats are written as 8 bytes whatever their width,
+// pointers are hashed by what they point to (never their address,
+// other than to detect cycles), and maps independently of iteration
+// order. TestGoldenSum locks down the encoding; changing it requires
+// updating that test's expected Sum and bumping EncodingVersion, and
+// invalidates previously stored Sums.
+//
+// The exceptions are values containing a map that forms part of a
+// cycle and has pointer keys, whose order then depends on the keys'
+// addresses; time.Time values that can't be read on a Go version
+// whose time.Time layout this package doesn't know (see
+// hasher.time); and AppendTo methods, whose output is up to each type.
+// AppendTo methods are only used for addressable values reached
+// through exported fields, and never for map keys and values (up to
+// the next pointer or slice), which aren't addressable on every Go
+// version and toolchain; elsewhere the value's fields are hashed.
+//
 // This package, like most of the tailscale.com Go module, should be
 // considered Tailscale-internal; we make no API promises.
 package deephash
@@ -16,10 +50,16 @@ import (
 	"encoding/hex"
 	"fmt"
 	"hash"
+	"io"
 	"math"
 	"reflect"
+	"sort"
 	"strconv"
 	"sync"
+	"time"
+	"unsafe"
+
+	"inet.af/netaddr"
 )
 
 const scratchSize = 128
@@ -31,6 +71,24 @@ type hasher struct {
 	bw      *bufio.Writer
 	scratch [scratchSize]byte
 	visited map[uintptr]bool
+
+	// ignore, if non-nil, is the set of dotted struct field paths
+	// to skip. See HashIgnoring.
+	ignore map[string]bool
+	// norm, if non-nil, is the normalizer of HashWithNormalizer.
+	norm func(path string, rv reflect.Value) (interface{}, bool)
+	// path is the dotted struct field path of the value currently
+	// being printed. It's only maintained when ignore or norm is
+	// non-nil.
+	path string
+	// stableFieldOrder is HashOptions.StableFieldOrder.
+	stableFieldOrder bool
+	// inMapEntry is whether the value being printed is, or is part
+	// of, a map key or value, up to the next pointer or slice. Map
+	// entries are only addressable when copied into scratch values,
+	// which not every Go version or map allows, so they're treated
+	// as unaddressable throughout to hash alike either way.
+	inMapEntry bool
 }
 
 // newHasher initializes a new hasher, for use by hasherPool.
@@ -62,11 +120,29 @@ func (s Sum) String() string {
 	return hex.EncodeToString(s.sum[:])
 }
 
+// EncodingVersion identifies the encoding that Sums are computed
+// from. Sums are only comparable with others of the same version, so
+// those stored or sent to other machines should be kept along with it.
+//
+// Version 1 was the original encoding. Version 2 changed, among
+// other things, how floats, interfaces, map entries with AppendTo
+// methods and netaddr slices are hashed. Version 3, described in the
+// package doc, hashes time.Time values by their instant, and writes
+// signed integers and bools at a fixed width so that consecutive ones,
+// such as a map entry's key and value, can't run together.
+const EncodingVersion = 3
+
 // Hash returns the hash of v.
-func (h *hasher) Hash(v interface{}) (hash Sum) {
+func (h *hasher) Hash(v interface{}) Sum {
 	h.bw.Flush()
 	h.h.Reset()
 	h.print(reflect.ValueOf(v))
+	return h.sum()
+}
+
+// sum returns the hash of everything written to h since its last
+// Reset.
+func (h *hasher) sum() (hash Sum) {
 	h.bw.Flush()
 	// Sum into scratch & copy out, as hash.Hash is an interface
 	// so the slice necessarily escapes, and there's no sha256
@@ -81,16 +157,116 @@ var hasherPool = &sync.Pool{
 	New: func() interface{} { return newHasher() },
 }
 
+// reset clears h's per-hash state, for reuse from hasherPool.
+func (h *hasher) reset() {
+	for k := range h.visited {
+		delete(h.visited, k)
+	}
+	h.ignore = nil
+	h.norm = nil
+	h.path = ""
+	h.stableFieldOrder = false
+}
+
 // Hash returns the hash of v.
 func Hash(v interface{}) Sum {
 	h := hasherPool.Get().(*hasher)
 	defer hasherPool.Put(h)
-	for k := range h.visited {
-		delete(h.visited, k)
+	h.reset()
+	return h.Hash(v)
+}
+
+// HashIgnoring is like Hash but skips the struct fields named by
+// paths, so that values differing only in those fields hash equally.
+//
+// Each path is a dot-separated list of struct field names starting
+// at the root, such as "Peers.LastSeen". Pointers, interfaces,
+// slices, arrays and maps don't add to the path, so in that example
+// LastSeen is skipped in every element of Peers.
+func HashIgnoring(v interface{}, paths []string) Sum {
+	h := hasherPool.Get().(*hasher)
+	defer hasherPool.Put(h)
+	h.reset()
+	h.ignore = make(map[string]bool, len(paths))
+	for _, p := range paths {
+		h.ignore[p] = true
 	}
+	defer h.reset() // don't pin ignore in the pool
+	return h.Hash(v)
+}
+
+// HashWithNormalizer is like Hash but lets norm substitute a
+// canonical form for struct fields whose exact values shouldn't
+// affect the hash, such as timestamps.
+//
+// norm is called for each struct field with the field's path, as
+// described for HashIgnoring, and its value. If it returns ok, the
+// field is hashed as if its value were repl instead. Fields within
+// repl are in turn passed to norm.
+func HashWithNormalizer(v interface{}, norm func(path string, rv reflect.Value) (repl interface{}, ok bool)) Sum {
+	h := hasherPool.Get().(*hasher)
+	defer hasherPool.Put(h)
+	h.reset()
+	h.norm = norm
+	defer h.reset()
 	return h.Hash(v)
 }
 
+// HashOptions are options for HashWithOptions.
+// The zero value hashes the same as Hash.
+type HashOptions struct {
+	// StableFieldOrder hashes struct fields sorted by name, and
+	// identifies them by name rather than position. Long-lived
+	// hashes then survive fields being reordered in the source,
+	// though not renamed.
+	StableFieldOrder bool
+}
+
+// HashWithOptions is like Hash but with the given options.
+func HashWithOptions(v interface{}, opts HashOptions) Sum {
+	h := hasherPool.Get().(*hasher)
+	defer hasherPool.Put(h)
+	h.reset()
+	h.stableFieldOrder = opts.StableFieldOrder
+	defer h.reset()
+	return h.Hash(v)
+}
+
+// Hash64 returns a 64-bit hash of v, taken from the same encoding as
+// Hash.
+//
+// It's far more likely than a Sum to collide with another value's
+// hash. Use it only where a collision is harmless, such as a cache
+// key where one just causes a redundant recomputation, and use Hash
+// wherever correctness depends on telling values apart.
+func Hash64(v interface{}) uint64 {
+	s := Hash(v)
+	return binary.BigEndian.Uint64(s.sum[:8])
+}
+
+// HashReader returns the same Sum as Hash of a []byte holding all of
+// r's content, but reads r in chunks rather than requiring it all
+// in memory at once.
+func HashReader(r io.Reader) (Sum, error) {
+	h := hasherPool.Get().(*hasher)
+	defer hasherPool.Put(h)
+	h.reset()
+	h.bw.Flush()
+	h.h.Reset()
+	buf := make([]byte, byteChunkSize)
+	for {
+		n, err := io.ReadFull(r, buf)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return Sum{}, err
+		}
+		h.int(n)
+		h.bw.Write(buf[:n])
+		if n < len(buf) {
+			return h.sum(), nil
+		}
+	}
+}
+
 // Update sets last to the hash of v and reports whether its value changed.
 func Update(last *Sum, v ...interface{}) (changed bool) {
 	sum := Hash(v)
@@ -108,6 +284,23 @@ type appenderTo interface {
 	AppendTo([]byte) []byte
 }
 
+// appenderToCache maps a reflect.Type to whether it implements
+// appenderTo. Type.Implements is slow enough, for types with many
+// methods such as time.Time, to dominate hashing large structs.
+var appenderToCache sync.Map
+
+func implementsAppendTo(t reflect.Type) bool {
+	if t.NumMethod() == 0 {
+		return false
+	}
+	if v, ok := appenderToCache.Load(t); ok {
+		return v.(bool)
+	}
+	ok := t.Implements(appenderToType)
+	appenderToCache.Store(t, ok)
+	return ok
+}
+
 func (h *hasher) uint(i uint64) {
 	binary.BigEndian.PutUint64(h.scratch[:8], i)
 	h.bw.Write(h.scratch[:8])
@@ -118,7 +311,31 @@ func (h *hasher) int(i int) {
 	h.bw.Write(h.scratch[:8])
 }
 
-var uint8Type = reflect.TypeOf(byte(0))
+// byteChunkSize is the size of the chunks that byte slices are
+// hashed in. See hasher.bytes.
+const byteChunkSize = 32 << 10
+
+// bytes writes b as a series of length-prefixed chunks: zero or more
+// full ones of byteChunkSize bytes, then a final, shorter one, which
+// may be empty. That way the length needn't be known up front, as
+// is the case for HashReader. Slices shorter than byteChunkSize are
+// written as a single length-prefixed chunk, as any other slice is.
+func (h *hasher) bytes(b []byte) {
+	for len(b) >= byteChunkSize {
+		h.int(byteChunkSize)
+		h.bw.Write(b[:byteChunkSize])
+		b = b[byteChunkSize:]
+	}
+	h.int(len(b))
+	h.bw.Write(b)
+}
+
+var (
+	uint8Type    = reflect.TypeOf(byte(0))
+	ipPrefixType = reflect.TypeOf(netaddr.IPPrefix{})
+	ipPortType   = reflect.TypeOf(netaddr.IPPort{})
+	timeType     = reflect.TypeOf(time.Time{})
+)
 
 // print hashes v into w.
 // It reports whether it was able to do so without hitting a cycle.
@@ -132,7 +349,7 @@ func (h *hasher) print(v reflect.Value) (acyclic bool) {
 
 	if v.CanInterface() {
 		// Use AppendTo methods, if available and cheap.
-		if v.CanAddr() && v.Type().Implements(appenderToType) {
+		if h.canAddr(v) && implementsAppendTo(v.Type()) {
 			a := v.Addr().Interface().(appenderTo)
 			scratch := a.AppendTo(h.scratch[:0])
 			w.Write(scratch)
@@ -150,23 +367,28 @@ func (h *hasher) print(v reflect.Value) (acyclic bool) {
 			return false
 		}
 		visited[ptr] = true
-		return h.print(v.Elem())
+		inMapEntry := h.inMapEntry
+		h.inMapEntry = false // what a pointer points to is always addressable
+		acyclic = h.print(v.Elem())
+		h.inMapEntry = inMapEntry
+		return acyclic
 	case reflect.Struct:
-		acyclic = true
-		w.WriteString("struct")
-		h.int(v.NumField())
-		for i, n := 0, v.NumField(); i < n; i++ {
-			h.int(i)
-			if !h.print(v.Field(i)) {
-				acyclic = false
-			}
+		if v.Type() == timeType {
+			return h.time(v)
 		}
-		return acyclic
+		return h.printStruct(v)
 	case reflect.Slice, reflect.Array:
+		if v.Kind() == reflect.Slice && v.Type().Elem() == uint8Type && v.CanInterface() {
+			h.bytes(v.Bytes())
+			return true
+		}
 		vLen := v.Len()
 		if v.Kind() == reflect.Slice {
 			h.int(vLen)
 		}
+		if h.hashNetaddrSlice(v) {
+			return true
+		}
 		if v.Type().Elem() == uint8Type && v.CanInterface() {
 			if vLen > 0 && vLen <= scratchSize {
 				// If it fits in scratch, avoid the Interface allocation.
@@ -181,14 +403,26 @@ func (h *hasher) print(v reflect.Value) (acyclic bool) {
 			return true
 		}
 		acyclic = true
+		inMapEntry := h.inMapEntry
+		if v.Kind() == reflect.Slice {
+			h.inMapEntry = false // slice elements are always addressable
+		}
 		for i := 0; i < vLen; i++ {
 			h.int(i)
 			if !h.print(v.Index(i)) {
 				acyclic = false
 			}
 		}
+		h.inMapEntry = inMapEntry
 		return acyclic
 	case reflect.Interface:
+		if v.IsNil() {
+			h.int(0)
+			return true
+		}
+		id := typeID(v.Elem().Type())
+		h.int(len(id))
+		w.WriteString(id)
 		return h.print(v.Elem())
 	case reflect.Map:
 		// TODO(bradfitz): ideally we'd avoid these map
@@ -221,24 +455,313 @@ func (h *hasher) print(v reflect.Value) (acyclic bool) {
 		h.int(v.Len())
 		w.WriteString(v.String())
 	case reflect.Bool:
-		w.Write(strconv.AppendBool(h.scratch[:0], v.Bool()))
+		if v.Bool() {
+			w.WriteByte(1)
+		} else {
+			w.WriteByte(0)
+		}
 	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
-		w.Write(strconv.AppendInt(h.scratch[:0], v.Int(), 10))
+		h.uint(uint64(v.Int()))
 	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
 		h.uint(v.Uint())
 	case reflect.Float32, reflect.Float64:
-		w.Write(strconv.AppendUint(h.scratch[:0], math.Float64bits(v.Float()), 10))
+		h.float(v.Float())
 	case reflect.Complex64, reflect.Complex128:
-		fmt.Fprintf(w, "%v", v.Complex())
+		c := v.Complex()
+		h.float(real(c))
+		h.float(imag(c))
+	}
+	return true
+}
+
+// canAddr reports whether v is addressable and, if so, whether it
+// should be treated as such. See hasher.inMapEntry.
+func (h *hasher) canAddr(v reflect.Value) bool {
+	return v.CanAddr() && !h.inMapEntry
+}
+
+// time writes v, a time.Time, as its instant: seconds and nanoseconds
+// since the Unix epoch.
+//
+// If the instant can't be read, which takes knowing time.Time's
+// unexported layout for a value in an unexported field that isn't
+// addressable, v is hashed by its fields instead, location and
+// monotonic clock reading included.
+func (h *hasher) time(v reflect.Value) (acyclic bool) {
+	t, ok := timeOf(v)
+	if !ok {
+		return h.printStruct(v)
+	}
+	h.bw.WriteString("time")
+	h.uint(uint64(t.Unix()))
+	h.uint(uint64(t.Nanosecond()))
+	return true
+}
+
+// timeOf returns the time.Time in v, if it can.
+//
+// v may come from an unexported struct field, whose value reflect
+// won't hand out with Interface. Then it's read through its address
+// or, if it's not addressable (as in a struct passed by value),
+// rebuilt from its fields, provided that time.Time is laid out as
+// timeLayoutKnown expects.
+func timeOf(v reflect.Value) (_ time.Time, ok bool) {
+	switch {
+	case v.CanInterface() && v.CanAddr():
+		return *v.Addr().Interface().(*time.Time), true
+	case v.CanInterface():
+		return v.Interface().(time.Time), true
+	case v.CanAddr():
+		return *(*time.Time)(unsafe.Pointer(v.UnsafeAddr())), true
+	case !timeLayoutKnown:
+		return time.Time{}, false
+	}
+	return rebuildTime(v), true
+}
+
+// rebuildTime copies the fields of v, a time.Time, into a new one.
+// It depends on time.Time's fields all being integers or pointers,
+// which timeLayoutKnown checks.
+func rebuildTime(v reflect.Value) time.Time {
+	var t time.Time
+	p := unsafe.Pointer(&t)
+	for i, n := 0, v.NumField(); i < n; i++ {
+		fp := unsafe.Pointer(uintptr(p) + timeType.Field(i).Offset)
+		switch f := v.Field(i); f.Kind() {
+		case reflect.Uint64:
+			*(*uint64)(fp) = f.Uint()
+		case reflect.Int64:
+			*(*int64)(fp) = f.Int()
+		case reflect.Ptr:
+			*(*unsafe.Pointer)(fp) = unsafe.Pointer(f.Pointer())
+		}
+	}
+	return t
+}
+
+// timeLayoutKnown is whether rebuildTime works with this Go version's
+// time.Time: whether its fields are all of kinds that rebuildTime
+// copies, and a time.Time rebuilt from an unexported field is equal to
+// the original.
+var timeLayoutKnown = func() bool {
+	for i := 0; i < timeType.NumField(); i++ {
+		switch timeType.Field(i).Type.Kind() {
+		case reflect.Uint64, reflect.Int64, reflect.Ptr:
+		default:
+			return false
+		}
+	}
+	want := time.Unix(1600000000, 123).In(time.FixedZone("X", -7200))
+	v := reflect.ValueOf(struct{ t time.Time }{want}).Field(0)
+	got := rebuildTime(v)
+	return got.Equal(want) && got.Location() == want.Location()
+}()
+
+// float writes f in canonical form, so that all NaNs hash alike, as
+// do -0 and +0. It's written at a fixed width so that consecutive
+// floats, such as the parts of a complex number, can't run together.
+func (h *hasher) float(f float64) {
+	switch {
+	case math.IsNaN(f):
+		f = math.NaN()
+	case f == 0:
+		f = 0
+	}
+	h.uint(math.Float64bits(f))
+}
+
+// hashNetaddrSlice hashes v, a slice or array, if its elements are
+// netaddr.IPPrefix or netaddr.IPPort, writing each element in a
+// compact binary form instead of walking it with reflection. These
+// are common in router and wgcfg configs. It reports whether it
+// handled v.
+func (h *hasher) hashNetaddrSlice(v reflect.Value) bool {
+	et := v.Type().Elem()
+	if (et != ipPrefixType && et != ipPortType) || !v.CanInterface() {
+		return false
+	}
+	if v.Kind() == reflect.Array && !h.canAddr(v) {
+		return false
+	}
+	// Slice elements are always addressable, so taking their
+	// addresses avoids the allocation of converting v itself to
+	// an interface.
+	if et == ipPrefixType {
+		for i, n := 0, v.Len(); i < n; i++ {
+			p := v.Index(i).Addr().Interface().(*netaddr.IPPrefix)
+			b := appendNetaddrIP(h.scratch[:0], p.IP())
+			h.bw.Write(append(b, p.Bits()))
+			h.hashZone(p.IP())
+		}
+		return true
+	}
+	for i, n := 0, v.Len(); i < n; i++ {
+		p := v.Index(i).Addr().Interface().(*netaddr.IPPort)
+		b := appendNetaddrIP(h.scratch[:0], p.IP())
+		h.bw.Write(append(b, byte(p.Port()>>8), byte(p.Port())))
+		h.hashZone(p.IP())
 	}
 	return true
 }
 
+// appendNetaddrIP appends a fixed-width binary form of ip to b. The
+// leading byte distinguishes the zero IP, IPv4, IPv6 and IPv6 with a
+// zone; the zone itself is written by hashZone.
+func appendNetaddrIP(b []byte, ip netaddr.IP) []byte {
+	switch {
+	case ip.IsZero():
+		return append(b, 0)
+	case ip.Is4():
+		a := ip.As4()
+		return append(append(b, 4), a[:]...)
+	case ip.Zone() != "":
+		a := ip.As16()
+		return append(append(b, 'z'), a[:]...)
+	default:
+		a := ip.As16()
+		return append(append(b, 6), a[:]...)
+	}
+}
+
+// hashZone writes ip's IPv6 zone, if any. See appendNetaddrIP.
+func (h *hasher) hashZone(ip netaddr.IP) {
+	if z := ip.Zone(); z != "" {
+		h.int(len(z))
+		h.bw.WriteString(z)
+	}
+}
+
+// printStruct is the struct case of print. When h.ignore is set it
+// also tracks h.path and skips the ignored fields.
+func (h *hasher) printStruct(v reflect.Value) (acyclic bool) {
+	acyclic = true
+	w := h.bw
+	w.WriteString("struct")
+	h.int(v.NumField())
+	if h.ignore == nil && h.norm == nil && !h.stableFieldOrder {
+		for i, n := 0, v.NumField(); i < n; i++ {
+			h.int(i)
+			if !h.print(v.Field(i)) {
+				acyclic = false
+			}
+		}
+		return acyclic
+	}
+
+	t := v.Type()
+	var order []int
+	if h.stableFieldOrder {
+		order = sortedFields(t)
+	}
+	parent := h.path
+	defer func() { h.path = parent }()
+	for j, n := 0, v.NumField(); j < n; j++ {
+		i := j
+		if order != nil {
+			i = order[j]
+		}
+		name := t.Field(i).Name
+		if h.ignore != nil || h.norm != nil {
+			h.path = name
+			if parent != "" {
+				h.path = parent + "." + name
+			}
+			if h.ignore[h.path] {
+				continue
+			}
+		}
+		if h.stableFieldOrder {
+			h.int(len(name))
+			w.WriteString(name)
+		} else {
+			h.int(i)
+		}
+		fv := v.Field(i)
+		if h.norm != nil {
+			if repl, ok := h.norm(h.path, fv); ok {
+				fv = reflect.ValueOf(repl)
+			}
+		}
+		if !h.print(fv) {
+			acyclic = false
+		}
+	}
+	return acyclic
+}
+
+// sortedFieldsCache maps a struct reflect.Type to its []int
+// sortedFields result.
+var sortedFieldsCache sync.Map
+
+// sortedFields returns the field indexes of the struct type t,
+// sorted by field name.
+func sortedFields(t reflect.Type) []int {
+	if v, ok := sortedFieldsCache.Load(t); ok {
+		return v.([]int)
+	}
+	order := make([]int, t.NumField())
+	for i := range order {
+		order[i] = i
+	}
+	sort.Slice(order, func(i, j int) bool {
+		return t.Field(order[i]).Name < t.Field(order[j]).Name
+	})
+	sortedFieldsCache.Store(t, order)
+	return order
+}
+
+// typeIDCache maps a reflect.Type to its typeID result.
+var typeIDCache sync.Map
+
+// typeID returns a non-empty identifier for t: its package path and
+// name if it's a named type, or else the identifiers of the types
+// it's made of, such as "*tailscale.com/tailcfg.Node" or "[]int".
+// Unnamed types of other kinds, such as func types and struct types,
+// are identified by their string form.
+func typeID(t reflect.Type) string {
+	if v, ok := typeIDCache.Load(t); ok {
+		return v.(string)
+	}
+	id := newTypeID(t)
+	typeIDCache.Store(t, id)
+	return id
+}
+
+// newTypeID is the uncached form of typeID.
+func newTypeID(t reflect.Type) string {
+	if t.Name() != "" {
+		if t.PkgPath() != "" {
+			return t.PkgPath() + "." + t.Name()
+		}
+		return t.Name() // predeclared, such as int or error
+	}
+	switch t.Kind() {
+	case reflect.Ptr:
+		return "*" + typeID(t.Elem())
+	case reflect.Slice:
+		return "[]" + typeID(t.Elem())
+	case reflect.Array:
+		return "[" + strconv.Itoa(t.Len()) + "]" + typeID(t.Elem())
+	case reflect.Map:
+		return "map[" + typeID(t.Key()) + "]" + typeID(t.Elem())
+	case reflect.Chan:
+		switch t.ChanDir() {
+		case reflect.RecvDir:
+			return "<-chan " + typeID(t.Elem())
+		case reflect.SendDir:
+			return "chan<- " + typeID(t.Elem())
+		}
+		return "chan " + typeID(t.Elem())
+	}
+	return t.String()
+}
+
 type mapHasher struct {
 	xbuf [sha256.Size]byte // XOR'ed accumulated buffer
 	ebuf [sha256.Size]byte // scratch buffer
 	s256 hash.Hash         // sha256 hash.Hash
 	bw   *bufio.Writer     // to hasher into ebuf
+	key  valueCache        // re-usable keys for map iteration
 	val  valueCache        // re-usable values for map iteration
 	iter *reflect.MapIter  // re-usable map iterator
 }
@@ -269,6 +792,7 @@ var mapHasherPool = &sync.Pool{
 		mh := new(mapHasher)
 		mh.s256 = sha256.New()
 		mh.bw = bufio.NewWriter(mh.s256)
+		mh.key = make(valueCache)
 		mh.val = make(valueCache)
 		mh.iter = new(reflect.MapIter)
 		return mh
@@ -300,11 +824,24 @@ func (h *hasher) hashMapAcyclic(v reflect.Value) (acyclic bool) {
 	oldw := h.setBufioWriter(mh.bw)
 	defer h.setBufioWriter(oldw)
 
-	k := mh.val.get(v.Type().Key())
+	// Keys and values have their own scratch values, so that
+	// neither overwrites the other when they're of the same type.
+	k := mh.key.get(v.Type().Key())
 	e := mh.val.get(v.Type().Elem())
+	// Copying into scratch values isn't allowed for maps reached
+	// through unexported fields, so those allocate. Either way the
+	// entries are hashed as unaddressable.
+	scratch := v.CanInterface()
+	inMapEntry := h.inMapEntry
+	h.inMapEntry = true
+	defer func() { h.inMapEntry = inMapEntry }()
 	for iter.Next() {
-		key := iterKey(iter, k)
-		val := iterVal(iter, e)
+		var key, val reflect.Value
+		if scratch {
+			key, val = iterKey(iter, k), iterVal(iter, e)
+		} else {
+			key, val = iter.Key(), iter.Value()
+		}
 		mh.startEntry()
 		if !h.print(key) {
 			return false
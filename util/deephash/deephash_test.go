@@ -7,9 +7,16 @@ package deephash
 import (
 	"bufio"
 	"bytes"
+	"errors"
 	"fmt"
+	htmltemplate "html/template"
+	"io"
+	"math"
 	"reflect"
 	"testing"
+	"testing/iotest"
+	texttemplate "text/template"
+	"time"
 
 	"inet.af/netaddr"
 	"tailscale.com/tailcfg"
@@ -173,6 +180,47 @@ func TestHashMapAcyclic(t *testing.T) {
 	}
 }
 
+func TestHashUnexportedMap(t *testing.T) {
+	type T struct{ m map[string]int }
+	a := &T{m: map[string]int{"a": 1, "b": 2}}
+	b := &T{m: map[string]int{"b": 2, "a": 1}}
+	if Hash(a) != Hash(b) {
+		t.Error("equal maps in unexported fields hashed differently")
+	}
+	b.m["b"] = 3
+	if Hash(a) == Hash(b) {
+		t.Error("different maps in unexported fields hashed the same")
+	}
+}
+
+// appendKey is a map key type with an AppendTo method.
+type appendKey struct{ n int }
+
+func (k appendKey) AppendTo(b []byte) []byte { return append(b, "appendKey"...) }
+
+func TestHashMapAppendTo(t *testing.T) {
+	// Map entries hash alike whether or not the map's entries can be
+	// copied into addressable scratch values, which depends on the
+	// Go version and on whether the map is in an exported field.
+	type exported struct{ M map[appendKey]appendKey }
+	type unexported struct{ m map[appendKey]appendKey }
+	m := map[appendKey]appendKey{{1}: {2}, {3}: {4}}
+	if Hash(&exported{M: m}) != Hash(&unexported{m: m}) {
+		t.Error("equal maps hashed differently in exported and unexported fields")
+	}
+	m2 := map[appendKey]appendKey{{1}: {2}, {3}: {5}}
+	if Hash(&exported{M: m}) == Hash(&exported{M: m2}) {
+		t.Error("different map values hashed the same")
+	}
+
+	type exportedArrays struct{ M map[[1]netaddr.IPPort]bool }
+	type unexportedArrays struct{ m map[[1]netaddr.IPPort]bool }
+	am := map[[1]netaddr.IPPort]bool{{netaddr.MustParseIPPort("1.2.3.4:5")}: true}
+	if Hash(&exportedArrays{M: am}) != Hash(&unexportedArrays{m: am}) {
+		t.Error("equal maps of netaddr arrays hashed differently in exported and unexported fields")
+	}
+}
+
 func TestPrintArray(t *testing.T) {
 	type T struct {
 		X [32]byte
@@ -230,6 +278,81 @@ func BenchmarkTailcfgNode(b *testing.B) {
 	}
 }
 
+// exampleNode returns a tailcfg.Node with its fields filled in the
+// way a typical peer in a map response has them.
+func exampleNode() *tailcfg.Node {
+	lastSeen := time.Unix(1620000000, 0)
+	online := true
+	return &tailcfg.Node{
+		ID:        1234,
+		StableID:  "nStable1234CNTRL",
+		Name:      "foo.example.com.beta.tailscale.net.",
+		User:      5678,
+		Key:       tailcfg.NodeKey{1: 1, 31: 31},
+		KeyExpiry: time.Unix(1640000000, 0),
+		Machine:   tailcfg.MachineKey{2: 2},
+		DiscoKey:  tailcfg.DiscoKey{3: 3},
+		Addresses: []netaddr.IPPrefix{
+			netaddr.MustParseIPPrefix("100.101.102.103/32"),
+			netaddr.MustParseIPPrefix("fd7a:115c:a1e0:ab12:4843:cd96:6265:6667/128"),
+		},
+		AllowedIPs: []netaddr.IPPrefix{
+			netaddr.MustParseIPPrefix("100.101.102.103/32"),
+			netaddr.MustParseIPPrefix("fd7a:115c:a1e0:ab12:4843:cd96:6265:6667/128"),
+			netaddr.MustParseIPPrefix("10.0.0.0/16"),
+		},
+		Endpoints: []string{"1.2.3.4:41641", "192.168.1.10:41641", "[2001:db8::10]:41641"},
+		DERP:      "127.3.3.40:2",
+		Hostinfo: tailcfg.Hostinfo{
+			IPNVersion:  "1.10.0-t1234abcd-g5678ef",
+			OS:          "linux",
+			OSVersion:   "Debian 10.4; kernel=5.10.0",
+			Hostname:    "foo",
+			GoArch:      "amd64",
+			RoutableIPs: []netaddr.IPPrefix{netaddr.MustParseIPPrefix("10.0.0.0/16")},
+			RequestTags: []string{"tag:server", "tag:prod"},
+			Services: []tailcfg.Service{
+				{Proto: tailcfg.TCP, Port: 22},
+				{Proto: tailcfg.TCP, Port: 443, Description: "https"},
+			},
+			NetInfo: &tailcfg.NetInfo{
+				PreferredDERP: 2,
+				LinkType:      "wired",
+				DERPLatency:   map[string]float64{"1-v4": 0.1, "2-v4": 0.02, "2-v6": 0.03},
+			},
+		},
+		Created:              time.Unix(1600000000, 0),
+		LastSeen:             &lastSeen,
+		Online:               &online,
+		KeepAlive:            true,
+		MachineAuthorized:    true,
+		ComputedName:         "foo",
+		ComputedNameWithHost: "foo",
+	}
+}
+
+func BenchmarkTailcfgNodeFull(b *testing.B) {
+	b.ReportAllocs()
+
+	node := exampleNode()
+	for i := 0; i < b.N; i++ {
+		sink = Hash(node)
+	}
+}
+
+func BenchmarkTailcfgPeers(b *testing.B) {
+	b.ReportAllocs()
+
+	peers := make([]*tailcfg.Node, 100)
+	for i := range peers {
+		peers[i] = exampleNode()
+		peers[i].ID = tailcfg.NodeID(i)
+	}
+	for i := 0; i < b.N; i++ {
+		sink = Hash(peers)
+	}
+}
+
 func TestExhaustive(t *testing.T) {
 	seen := make(map[Sum]bool)
 	for i := 0; i < 100000; i++ {
@@ -280,3 +403,636 @@ func BenchmarkHashArray(b *testing.B) {
 		sink = Hash(x)
 	}
 }
+
+func TestExplain(t *testing.T) {
+	type inner struct {
+		C int
+	}
+	type outer struct {
+		A string
+		B []inner
+		M map[string]int
+		I interface{}
+	}
+	base := func() *outer {
+		return &outer{
+			A: "foo",
+			B: []inner{{1}, {2}},
+			M: map[string]int{"x": 1, "y": 2},
+			I: 1,
+		}
+	}
+	tests := []struct {
+		name   string
+		modify func(*outer)
+		want   string // empty means equal
+	}{
+		{"equal", func(*outer) {}, ""},
+		{"string", func(o *outer) { o.A = "bar" }, ".A"},
+		{"nested", func(o *outer) { o.B[1].C = 3 }, ".B[1].C"},
+		{"length", func(o *outer) { o.B = o.B[:1] }, ".B (length 2 vs 1)"},
+		{"map_value", func(o *outer) { o.M["y"] = 3 }, `.M["y"]`},
+		{"map_key", func(o *outer) { o.M["z"] = 3 }, `.M["z"] (key only in b)`},
+		{"type_mismatch", func(o *outer) { o.I = "1" }, ".I (type mismatch: int vs string)"},
+		{"nil_interface", func(o *outer) { o.I = nil }, ".I (int vs nil)"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, b := base(), base()
+			tt.modify(b)
+			equal, path := Explain(a, b)
+			if equal != (tt.want == "") || path != tt.want {
+				t.Errorf("Explain = %v, %q; want %v, %q", equal, path, tt.want == "", tt.want)
+			}
+			if hashEqual := Hash(a) == Hash(b); hashEqual != equal {
+				t.Errorf("Explain equal = %v; but Hash equal = %v", equal, hashEqual)
+			}
+		})
+	}
+}
+
+func TestExplainPointerKeys(t *testing.T) {
+	// Hash matches map entries by what their keys point to, while
+	// sorting pointer keys orders them by address. Give b its keys
+	// in the opposite address order to a's.
+	var ints [4]int
+	ints[0], ints[1], ints[2], ints[3] = 1, 2, 2, 1
+	a := map[*int]string{&ints[0]: "one", &ints[1]: "two"}
+	b := map[*int]string{&ints[3]: "one", &ints[2]: "two"}
+	if Hash(a) != Hash(b) {
+		t.Fatal("maps unexpectedly hash differently")
+	}
+	if equal, path := Explain(a, b); !equal {
+		t.Errorf("Explain = false, %q; want true", path)
+	}
+
+	b[&ints[2]] = "deux"
+	want := fmt.Sprintf("[%#v]", &ints[1])
+	if equal, path := Explain(a, b); equal || path != want {
+		t.Errorf("Explain = %v, %q; want false, %q", equal, path, want)
+	}
+}
+
+func TestExplainRoot(t *testing.T) {
+	if equal, path := Explain(1, 2); equal || path != "" {
+		t.Errorf("Explain(1, 2) = %v, %q; want false, \"\"", equal, path)
+	}
+	if equal, path := Explain(1, "1"); equal || path != "(type mismatch: int vs string)" {
+		t.Errorf("Explain(1, \"1\") = %v, %q", equal, path)
+	}
+}
+
+func TestHashIgnoring(t *testing.T) {
+	type peer struct {
+		Name     string
+		LastSeen int64
+	}
+	type config struct {
+		Version int
+		Peers   []*peer
+		ByName  map[string]peer
+	}
+	a := &config{
+		Version: 1,
+		Peers:   []*peer{{"a", 10}, {"b", 20}},
+		ByName:  map[string]peer{"a": {"a", 10}},
+	}
+	b := &config{
+		Version: 1,
+		Peers:   []*peer{{"a", 11}, {"b", 21}},
+		ByName:  map[string]peer{"a": {"a", 11}},
+	}
+
+	if Hash(a) == Hash(b) {
+		t.Fatal("values unexpectedly hash equally")
+	}
+	if got, want := HashIgnoring(a, nil), Hash(a); got != want {
+		t.Errorf("HashIgnoring with no paths = %v; want Hash = %v", got, want)
+	}
+	ignoreBoth := []string{"Peers.LastSeen", "ByName.LastSeen"}
+	if HashIgnoring(a, ignoreBoth) != HashIgnoring(b, ignoreBoth) {
+		t.Error("values differing only in ignored fields hash differently")
+	}
+	if HashIgnoring(a, []string{"Peers.LastSeen"}) == HashIgnoring(b, []string{"Peers.LastSeen"}) {
+		t.Error("ByName.LastSeen was ignored but not asked to be")
+	}
+	if HashIgnoring(a, []string{"LastSeen"}) == HashIgnoring(b, []string{"LastSeen"}) {
+		t.Error("top-level path LastSeen unexpectedly matched nested fields")
+	}
+
+	b.Version = 2
+	if HashIgnoring(a, ignoreBoth) == HashIgnoring(b, ignoreBoth) {
+		t.Error("non-ignored difference didn't change hash")
+	}
+}
+
+func TestHashNetaddrSlices(t *testing.T) {
+	type T struct {
+		Prefixes []netaddr.IPPrefix
+		Ports    []netaddr.IPPort
+		Array    [2]netaddr.IPPrefix
+	}
+	base := func() *T {
+		return &T{
+			Prefixes: []netaddr.IPPrefix{
+				netaddr.MustParseIPPrefix("1.2.3.0/24"),
+				netaddr.MustParseIPPrefix("1234::/64"),
+			},
+			Ports: []netaddr.IPPort{
+				netaddr.MustParseIPPort("1.2.3.4:5"),
+				netaddr.IPPortFrom(netaddr.MustParseIP("fe80::1%eth0"), 53),
+			},
+			Array: [2]netaddr.IPPrefix{netaddr.MustParseIPPrefix("10.0.0.0/8")},
+		}
+	}
+	if Hash(base()) != Hash(base()) {
+		t.Fatal("equal values hash differently")
+	}
+	modifications := map[string]func(*T){
+		"prefix_bits":  func(v *T) { v.Prefixes[0] = netaddr.MustParseIPPrefix("1.2.3.0/25") },
+		"prefix_ip":    func(v *T) { v.Prefixes[1] = netaddr.MustParseIPPrefix("1235::/64") },
+		"prefix_extra": func(v *T) { v.Prefixes = append(v.Prefixes, netaddr.IPPrefix{}) },
+		"port":         func(v *T) { v.Ports[0] = netaddr.MustParseIPPort("1.2.3.4:6") },
+		"port_ip":      func(v *T) { v.Ports[0] = netaddr.MustParseIPPort("[102:304::]:5") },
+		"port_zone":    func(v *T) { v.Ports[1] = netaddr.IPPortFrom(netaddr.MustParseIP("fe80::1%eth1"), 53) },
+		"port_no_zone": func(v *T) { v.Ports[1] = netaddr.IPPortFrom(netaddr.MustParseIP("fe80::1"), 53) },
+		"array":        func(v *T) { v.Array[1] = netaddr.MustParseIPPrefix("10.0.0.0/8") },
+	}
+	for name, modify := range modifications {
+		v := base()
+		modify(v)
+		if Hash(v) == Hash(base()) {
+			t.Errorf("%s: modified value hashes the same", name)
+		}
+	}
+}
+
+func TestPrintNetaddrZone(t *testing.T) {
+	var got bytes.Buffer
+	bw := bufio.NewWriter(&got)
+	h := &hasher{
+		bw:      bw,
+		visited: map[uintptr]bool{},
+	}
+	h.print(reflect.ValueOf([]netaddr.IPPort{netaddr.IPPortFrom(netaddr.MustParseIP("fe80::1%eth0"), 53)}))
+	bw.Flush()
+	const want = "\x00\x00\x00\x00\x00\x00\x00\x01" + // 1 element
+		"z\xfe\x80\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x01" + // zoned IPv6
+		"\x00\x35" + // port 53
+		"\x00\x00\x00\x00\x00\x00\x00\x04eth0" // zone
+	if got := got.Bytes(); string(got) != want {
+		t.Errorf("wrong:\n got: %q\nwant: %q\n", got, want)
+	}
+}
+
+func TestPrintNetaddrGolden(t *testing.T) {
+	// The netaddr slices in TestGoldenSum, with their encoding worked
+	// out by hand, so that the golden Sum doesn't rest on whichever
+	// netaddr it was first computed with.
+	encode := func(v interface{}) string {
+		var got bytes.Buffer
+		bw := bufio.NewWriter(&got)
+		h := &hasher{
+			bw:      bw,
+			visited: map[uintptr]bool{},
+		}
+		h.print(reflect.ValueOf(v))
+		bw.Flush()
+		return got.String()
+	}
+	pre := []netaddr.IPPrefix{netaddr.MustParseIPPrefix("10.0.0.0/8"), netaddr.MustParseIPPrefix("fd7a:115c::/48")}
+	const wantPre = "\x00\x00\x00\x00\x00\x00\x00\x02" + // 2 elements
+		"\x04\x0a\x00\x00\x00" + "\x08" + // IPv4, /8
+		"\x06\xfd\x7a\x11\x5c\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00" + "\x30" // IPv6, /48
+	if got := encode(pre); got != wantPre {
+		t.Errorf("prefixes:\n got: %q\nwant: %q", got, wantPre)
+	}
+	pp := []netaddr.IPPort{netaddr.MustParseIPPort("1.2.3.4:5"), netaddr.MustParseIPPort("[2001:db8::1]:443")}
+	const wantPp = "\x00\x00\x00\x00\x00\x00\x00\x02" + // 2 elements
+		"\x04\x01\x02\x03\x04" + "\x00\x05" + // IPv4, port 5
+		"\x06\x20\x01\x0d\xb8\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x01" + "\x01\xbb" // IPv6, port 443
+	if got := encode(pp); got != wantPp {
+		t.Errorf("ports:\n got: %q\nwant: %q", got, wantPp)
+	}
+}
+
+func TestNetaddrSliceAllocs(t *testing.T) {
+	if version.IsRace() {
+		t.Skip("skipping test under race detector")
+	}
+	type T struct {
+		Prefixes []netaddr.IPPrefix
+		Ports    []netaddr.IPPort
+	}
+	x := &T{
+		Prefixes: []netaddr.IPPrefix{netaddr.MustParseIPPrefix("10.0.0.0/8"), netaddr.MustParseIPPrefix("fd7a::/48")},
+		Ports:    []netaddr.IPPort{netaddr.MustParseIPPort("1.2.3.4:5")},
+	}
+	n := int(testing.AllocsPerRun(1000, func() {
+		sink = Hash(x)
+	}))
+	if n > 0 {
+		t.Errorf("allocs = %v; want 0", n)
+	}
+}
+
+func BenchmarkHashIPPrefixSlice(b *testing.B) {
+	b.ReportAllocs()
+	v := make([]netaddr.IPPrefix, 1000)
+	for i := range v {
+		v[i] = netaddr.IPPrefixFrom(netaddr.IPv4(10, byte(i>>8), byte(i), 0), 24)
+	}
+	for i := 0; i < b.N; i++ {
+		sink = Hash(&v)
+	}
+}
+
+func TestHashFloats(t *testing.T) {
+	type T struct {
+		F64 float64
+		F32 float32
+		C   complex128
+	}
+	negZero := math.Copysign(0, -1)
+	otherNaN := math.Float64frombits(0x7ff8000000000bad)
+	if !math.IsNaN(otherNaN) {
+		t.Fatal("otherNaN isn't NaN")
+	}
+	tests := []struct {
+		name  string
+		a, b  T
+		equal bool
+	}{
+		{"nan", T{F64: math.NaN()}, T{F64: otherNaN}, true},
+		{"nan32", T{F32: float32(math.NaN())}, T{F32: float32(otherNaN)}, true},
+		{"zero", T{F64: 0}, T{F64: negZero}, true},
+		{"zero32", T{F32: 0}, T{F32: float32(negZero)}, true},
+		{"complex", T{C: complex(negZero, math.NaN())}, T{C: complex(0, otherNaN)}, true},
+		{"nan_vs_zero", T{F64: math.NaN()}, T{F64: 0}, false},
+		{"nan_vs_inf", T{F64: math.NaN()}, T{F64: math.Inf(1)}, false},
+		{"complex_parts", T{C: complex(1, 2)}, T{C: complex(2, 1)}, false},
+		// The parts' decimal bit patterns, concatenated, would be
+		// the same "46071824188000174080".
+		{"complex_split", T{C: complex(1, 0)}, T{C: complex(math.Float64frombits(460718241880001740), math.Float64frombits(80))}, false},
+	}
+	for _, tt := range tests {
+		if got := Hash(tt.a) == Hash(tt.b); got != tt.equal {
+			t.Errorf("%s: hashes equal = %v; want %v", tt.name, got, tt.equal)
+		}
+	}
+}
+
+func TestHashStableFieldOrder(t *testing.T) {
+	type before struct {
+		Name  string
+		Port  int
+		Inner struct{ A, B int }
+	}
+	type after struct {
+		Inner struct{ B, A int }
+		Port  int
+		Name  string
+	}
+	b := before{Name: "foo", Port: 1}
+	b.Inner.A, b.Inner.B = 2, 3
+	a := after{Name: "foo", Port: 1}
+	a.Inner.A, a.Inner.B = 2, 3
+
+	if Hash(b) == Hash(a) {
+		t.Error("reordered structs unexpectedly hash equally by default")
+	}
+	opts := HashOptions{StableFieldOrder: true}
+	if HashWithOptions(b, opts) != HashWithOptions(a, opts) {
+		t.Error("reordered structs hash differently with StableFieldOrder")
+	}
+	a.Inner.A, a.Inner.B = 3, 2
+	if HashWithOptions(b, opts) == HashWithOptions(a, opts) {
+		t.Error("swapped field values hash equally with StableFieldOrder")
+	}
+	if HashWithOptions(b, HashOptions{}) != Hash(b) {
+		t.Error("zero HashOptions differs from Hash")
+	}
+}
+
+func TestHashReader(t *testing.T) {
+	for _, n := range []int{0, 1, 100, byteChunkSize - 1, byteChunkSize, byteChunkSize + 1, 3*byteChunkSize + 7, 1 << 20} {
+		b := make([]byte, n)
+		for i := range b {
+			b[i] = byte(i * 7)
+		}
+		want := Hash(b)
+		got, err := HashReader(bytes.NewReader(b))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != want {
+			t.Errorf("len %d: HashReader = %v; want %v", n, got, want)
+		}
+		// Short reads mustn't change the chunking.
+		got, err = HashReader(iotest.HalfReader(bytes.NewReader(b)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != want {
+			t.Errorf("len %d: HashReader with short reads = %v; want %v", n, got, want)
+		}
+	}
+
+	errBoom := errors.New("boom")
+	r := io.MultiReader(bytes.NewReader(make([]byte, byteChunkSize+1)), iotest.ErrReader(errBoom))
+	if _, err := HashReader(r); err != errBoom {
+		t.Errorf("err = %v; want %v", err, errBoom)
+	}
+}
+
+type hashIfaceA struct{ X int }
+type hashIfaceB struct{ X int }
+type hashIfaceInt int
+
+func TestHashInterfaceType(t *testing.T) {
+	type T struct{ V interface{} }
+	distinct := []interface{}{
+		T{},
+		T{hashIfaceA{1}},
+		T{hashIfaceB{1}},
+		T{&hashIfaceA{1}},
+		T{1},
+		T{hashIfaceInt(1)},
+		T{int64(1)},
+		T{[]int{1}},
+		T{[]hashIfaceInt{1}},
+	}
+	seen := map[Sum]int{}
+	for i, v := range distinct {
+		sum := Hash(v)
+		if j, ok := seen[sum]; ok {
+			t.Errorf("%#v and %#v hash the same", distinct[j], v)
+		}
+		seen[sum] = i
+	}
+	if a, b := Hash(T{hashIfaceA{1}}), Hash(T{hashIfaceA{1}}); a != b {
+		t.Errorf("equal values hash differently: %v vs %v", a, b)
+	}
+}
+
+func TestTypeID(t *testing.T) {
+	tests := []struct {
+		v    interface{}
+		want string
+	}{
+		{hashIfaceA{}, "tailscale.com/util/deephash.hashIfaceA"},
+		{&hashIfaceA{}, "*tailscale.com/util/deephash.hashIfaceA"},
+		{[]*hashIfaceA(nil), "[]*tailscale.com/util/deephash.hashIfaceA"},
+		{[2]hashIfaceA{}, "[2]tailscale.com/util/deephash.hashIfaceA"},
+		{map[string]*hashIfaceA(nil), "map[string]*tailscale.com/util/deephash.hashIfaceA"},
+		{(<-chan hashIfaceA)(nil), "<-chan tailscale.com/util/deephash.hashIfaceA"},
+		{1, "int"},
+		{[]byte(nil), "[]uint8"},
+		{(*error)(nil), "*error"},
+	}
+	for _, tt := range tests {
+		if got := typeID(reflect.TypeOf(tt.v)); got != tt.want {
+			t.Errorf("typeID(%T) = %q; want %q", tt.v, got, tt.want)
+		}
+	}
+
+	// Types from different packages of the same name don't collide.
+	if a, b := typeID(reflect.TypeOf(&texttemplate.Template{})), typeID(reflect.TypeOf(&htmltemplate.Template{})); a == b {
+		t.Errorf("*text/template.Template and *html/template.Template both have typeID %q", a)
+	}
+}
+
+func TestHashWithNormalizer(t *testing.T) {
+	type Peer struct {
+		Name     string
+		LastSeen time.Time
+	}
+	type T struct {
+		Peers []Peer
+		Seen  map[string]*time.Time
+	}
+	t1, t2 := time.Unix(1, 0), time.Unix(2, 0)
+	a := &T{Peers: []Peer{{"a", t1}}, Seen: map[string]*time.Time{"a": &t1}}
+	b := &T{Peers: []Peer{{"a", t2}}, Seen: map[string]*time.Time{"a": &t2}}
+	if Hash(a) == Hash(b) {
+		t.Fatal("values differing in timestamps hash equally without normalization")
+	}
+
+	paths := map[string]bool{}
+	norm := func(path string, rv reflect.Value) (interface{}, bool) {
+		paths[path] = true
+		switch path {
+		case "Peers.LastSeen":
+			return time.Time{}, true
+		case "Seen":
+			// Keep only the keys.
+			var keys []string
+			for _, k := range rv.MapKeys() {
+				keys = append(keys, k.String())
+			}
+			return keys, true
+		}
+		return nil, false
+	}
+	if HashWithNormalizer(a, norm) != HashWithNormalizer(b, norm) {
+		t.Error("normalized values hash differently")
+	}
+	for _, p := range []string{"Peers", "Peers.Name", "Peers.LastSeen", "Seen"} {
+		if !paths[p] {
+			t.Errorf("normalizer not called for %q; got %v", p, paths)
+		}
+	}
+
+	keep := func(string, reflect.Value) (interface{}, bool) { return nil, false }
+	if HashWithNormalizer(a, keep) != Hash(a) {
+		t.Error("a normalizer that changes nothing changed the hash")
+	}
+	c := &T{Peers: []Peer{{"c", t1}}, Seen: map[string]*time.Time{"a": &t1}}
+	if HashWithNormalizer(a, norm) == HashWithNormalizer(c, norm) {
+		t.Error("values differing in a kept field hash equally")
+	}
+}
+
+func TestHash64(t *testing.T) {
+	type T struct {
+		A int
+		B string
+	}
+	if Hash64(T{1, "x"}) != Hash64(T{1, "x"}) {
+		t.Error("equal values have different Hash64s")
+	}
+
+	// A smoke test for collisions: with a decent 64-bit hash, even
+	// two among this many values colliding would be astronomically
+	// unlikely.
+	seen := map[uint64]interface{}{}
+	check := func(v interface{}) {
+		h := Hash64(v)
+		if prev, ok := seen[h]; ok {
+			t.Fatalf("Hash64(%#v) == Hash64(%#v) == %x", v, prev, h)
+		}
+		seen[h] = v
+	}
+	for i := 0; i < 20000; i++ {
+		check(i)
+		check(fmt.Sprint(i))
+		check(T{i, ""})
+		check(T{0, fmt.Sprint(i)})
+		check([]int{i, i})
+	}
+}
+
+func TestHashTime(t *testing.T) {
+	now := time.Now() // has a monotonic clock reading
+	tests := []struct {
+		a, b time.Time
+		same bool
+	}{
+		{now, now.Round(0), true},
+		{now, now.In(time.FixedZone("X", 3600)), true},
+		{time.Unix(1, 0), time.Unix(1, 0).UTC(), true},
+		{time.Unix(1, 0), time.Unix(1, 1), false},
+		{time.Unix(1, 0), time.Unix(2, 0), false},
+		{time.Time{}, time.Unix(0, 0), false},
+	}
+	type unexported struct{ t time.Time }
+	for _, tt := range tests {
+		if got := Hash(&tt.a) == Hash(&tt.b); got != tt.same {
+			t.Errorf("Hash(%v) == Hash(%v) is %v; want %v", tt.a, tt.b, got, tt.same)
+		}
+		// Unexported fields, addressable or not, hash the same way.
+		a, b := unexported{tt.a}, unexported{tt.b}
+		if got := Hash(&a) == Hash(&b); got != tt.same {
+			t.Errorf("unexported: Hash(%v) == Hash(%v) is %v; want %v", tt.a, tt.b, got, tt.same)
+		}
+		if got := Hash(a) == Hash(b); got != tt.same {
+			t.Errorf("unexported by value: Hash(%v) == Hash(%v) is %v; want %v", tt.a, tt.b, got, tt.same)
+		}
+		ma, mb := map[int]unexported{1: a}, map[int]unexported{1: b}
+		if got := Hash(&ma) == Hash(&mb); got != tt.same {
+			t.Errorf("unexported in map: Hash(%v) == Hash(%v) is %v; want %v", tt.a, tt.b, got, tt.same)
+		}
+	}
+}
+
+func TestHashTimeUnknownLayout(t *testing.T) {
+	if !timeLayoutKnown {
+		t.Fatal("time.Time layout not recognized")
+	}
+	// Were time.Time's layout to change, times that can't be read
+	// are hashed by their fields rather than panicking.
+	timeLayoutKnown = false
+	defer func() { timeLayoutKnown = true }()
+	type unexported struct{ t time.Time }
+	a := unexported{time.Unix(1, 0)}
+	if Hash(a) != Hash(unexported{time.Unix(1, 0)}) {
+		t.Error("equal times hash differently")
+	}
+	if Hash(a) == Hash(unexported{time.Unix(2, 0)}) {
+		t.Error("different times hash the same")
+	}
+	// Times that can be read are unaffected.
+	if Hash(&a) != Hash(&unexported{time.Unix(1, 0).UTC()}) {
+		t.Error("addressable times aren't hashed by instant")
+	}
+}
+
+func TestHashFixedWidth(t *testing.T) {
+	// Consecutive values, such as a map entry's key and value, or
+	// adjacent struct fields, mustn't run together.
+	type ints struct{ A, B int }
+	type bools struct {
+		A bool
+		S string
+	}
+	tests := []struct {
+		name string
+		a, b interface{}
+	}{
+		{"map_int", map[int]int{1: 23}, map[int]int{12: 3}},
+		{"map_int8", map[int8]int8{1: 23}, map[int8]int8{12: 3}},
+		{"map_uint", map[uint]uint{1: 23}, map[uint]uint{12: 3}},
+		{"struct_int", ints{1, 23}, ints{12, 3}},
+		{"map_bool", map[bool]string{true: "x"}, map[bool]string{false: "x"}},
+		{"struct_bool", bools{true, "false"}, bools{false, "truefalse"}},
+	}
+	for _, tt := range tests {
+		if Hash(tt.a) == Hash(tt.b) {
+			t.Errorf("%s: Hash(%v) == Hash(%v)", tt.name, tt.a, tt.b)
+		}
+	}
+}
+
+// TestGoldenSum checks that a value covering each kind deephash
+// handles has the same Sum it always has, on every platform. If this
+// fails, the encoding changed, and Sums stored or computed elsewhere
+// won't match anymore; only update want if that's intended, and then
+// bump EncodingVersion too. TestPrintNetaddrGolden spells out the
+// encoding of its netaddr slices.
+func TestGoldenSum(t *testing.T) {
+	type inner struct {
+		S string
+		B []byte
+	}
+	type golden struct {
+		I   int
+		I8  int8
+		I64 int64
+		U   uint
+		U16 uint16
+		F32 float32
+		F64 float64
+		C   complex128
+		B   bool
+		S   string
+		Bs  []byte
+		A   [4]byte
+		Ss  []string
+		M   map[string]int
+		MP  map[int]*inner
+		MA  map[appendKey]appendKey
+		MAP map[string]*appendKey
+		P   *inner
+		Nil *inner
+		If  interface{}
+		IfP interface{}
+		T   time.Time
+		t   time.Time
+		Pre []netaddr.IPPrefix
+		Pp  []netaddr.IPPort
+	}
+	v := &golden{
+		I:   -1,
+		I8:  -128,
+		I64: 1 << 40,
+		U:   1 << 31,
+		U16: 65535,
+		F32: 1.5,
+		F64: math.Pi,
+		C:   complex(1, -2),
+		B:   true,
+		S:   "hello",
+		Bs:  []byte("world"),
+		A:   [4]byte{1, 2, 3, 4},
+		Ss:  []string{"a", "", "c"},
+		M:   map[string]int{"x": 1, "y": 2, "z": 3},
+		MP:  map[int]*inner{1: {S: "one"}, 2: {B: []byte{2}}},
+		MA:  map[appendKey]appendKey{{1}: {2}, {3}: {4}},
+		MAP: map[string]*appendKey{"a": {5}},
+		P:   &inner{S: "p", B: []byte{}},
+		If:  inner{S: "iface"},
+		IfP: &inner{S: "iface pointer"},
+		T:   time.Unix(1600000000, 123).In(time.FixedZone("X", -7200)),
+		t:   time.Unix(1600000001, 456).UTC(),
+		Pre: []netaddr.IPPrefix{netaddr.MustParseIPPrefix("10.0.0.0/8"), netaddr.MustParseIPPrefix("fd7a:115c::/48")},
+		Pp:  []netaddr.IPPort{netaddr.MustParseIPPort("1.2.3.4:5"), netaddr.MustParseIPPort("[2001:db8::1]:443")},
+	}
+	const wantVersion = 3
+	const want = "0a8c385775712b61eb36219bb859f004e5f99ab28f638fc5edc733e43d00211f"
+	if EncodingVersion != wantVersion {
+		t.Fatalf("EncodingVersion = %d; want %d along with a new expected Sum", EncodingVersion, wantVersion)
+	}
+	if got := Hash(v).String(); got != want {
+		t.Errorf("Sum = %s; want %s", got, want)
+	}
+}
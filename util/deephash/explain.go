@@ -0,0 +1,204 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package deephash
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"reflect"
+)
+
+// Explain reports whether a and b hash equally and, if not, the path
+// to the first difference found while walking both values in the
+// same order that Hash does.
+//
+// The path is in Go selector syntax relative to the root, such as
+// ".Peers[1].Name" or `.Hosts["foo."]`. A difference at the root
+// itself has an empty selector. When the difference is structural
+// rather than a differing leaf value, the path is followed by a
+// parenthesized note, such as "(type mismatch: int vs string)".
+//
+// Explain is intended for debugging unexpected hash changes; it is
+// much slower than Hash.
+func Explain(a, b interface{}) (equal bool, path string) {
+	e := &explainer{
+		visitedA: map[uintptr]bool{},
+		visitedB: map[uintptr]bool{},
+	}
+	path, differ := e.diff(reflect.ValueOf(a), reflect.ValueOf(b), "")
+	return !differ, path
+}
+
+// explainer is the state for a single Explain call.
+type explainer struct {
+	// visitedA and visitedB mirror hasher.visited for each side,
+	// so pointers and maps seen before are skipped just as print
+	// skips them.
+	visitedA map[uintptr]bool
+	visitedB map[uintptr]bool
+}
+
+// note returns path annotated with a parenthesized explanation.
+func note(path, format string, args ...interface{}) string {
+	msg := "(" + fmt.Sprintf(format, args...) + ")"
+	if path == "" {
+		return msg
+	}
+	return path + " " + msg
+}
+
+// diff walks a and b in parallel and returns the path of the first
+// difference, if any.
+func (e *explainer) diff(a, b reflect.Value, path string) (diffPath string, differ bool) {
+	switch {
+	case !a.IsValid() && !b.IsValid():
+		return "", false
+	case !a.IsValid():
+		return note(path, "nil vs %v", b.Type()), true
+	case !b.IsValid():
+		return note(path, "%v vs nil", a.Type()), true
+	case a.Type() != b.Type():
+		return note(path, "type mismatch: %v vs %v", a.Type(), b.Type()), true
+	}
+
+	if isLeaf(a) || isLeaf(b) {
+		if !bytes.Equal(encodeLeaf(a), encodeLeaf(b)) {
+			return path, true
+		}
+		return "", false
+	}
+
+	switch a.Kind() {
+	case reflect.Ptr:
+		if d, differ, done := e.visit(a, b, path); done {
+			return d, differ
+		}
+		return e.diff(a.Elem(), b.Elem(), path)
+	case reflect.Struct:
+		t := a.Type()
+		for i, n := 0, a.NumField(); i < n; i++ {
+			if d, differ := e.diff(a.Field(i), b.Field(i), path+"."+t.Field(i).Name); differ {
+				return d, true
+			}
+		}
+		return "", false
+	case reflect.Slice, reflect.Array:
+		if a.Len() != b.Len() {
+			return note(path, "length %d vs %d", a.Len(), b.Len()), true
+		}
+		for i, n := 0, a.Len(); i < n; i++ {
+			if d, differ := e.diff(a.Index(i), b.Index(i), fmt.Sprintf("%s[%d]", path, i)); differ {
+				return d, true
+			}
+		}
+		return "", false
+	case reflect.Interface:
+		return e.diff(a.Elem(), b.Elem(), path)
+	case reflect.Map:
+		if d, differ, done := e.visit(a, b, path); done {
+			return d, differ
+		}
+		return e.diffMap(a, b, path)
+	}
+	panic(fmt.Sprintf("unhandled kind %v for type %v", a.Kind(), a.Type()))
+}
+
+// visit records the pointers of a and b as visited. It reports done
+// if either was already visited, in which case print would not
+// descend into it again.
+func (e *explainer) visit(a, b reflect.Value, path string) (diffPath string, differ, done bool) {
+	pa, pb := a.Pointer(), b.Pointer()
+	seenA, seenB := e.visitedA[pa], e.visitedB[pb]
+	if seenA != seenB {
+		return note(path, "already visited on only one side"), true, true
+	}
+	if seenA {
+		return "", false, true
+	}
+	e.visitedA[pa] = true
+	e.visitedB[pb] = true
+	return "", false, false
+}
+
+// diffMap compares the maps a and b entry by entry. Entries are
+// matched as Hash matches them, by the encoding of their keys, rather
+// than by sorted key order: pointer and interface keys sort by
+// address, which says nothing about whether they hash equally. The
+// entries of a are then walked in sorted key order, and entries only
+// in b reported last.
+func (e *explainer) diffMap(a, b reflect.Value, path string) (diffPath string, differ bool) {
+	sa, sb := newSortedMap(a), newSortedMap(b)
+	// inB maps the encoding of each of b's keys to the indexes in sb
+	// of the entries with it. Distinct pointer keys can share one.
+	inB := map[string][]int{}
+	for j, k := range sb.Key {
+		enc := string(encodeMapKey(k))
+		inB[enc] = append(inB[enc], j)
+	}
+	matched := make([]bool, len(sb.Key))
+	for i, k := range sa.Key {
+		keyPath := fmt.Sprintf("%s[%#v]", path, k)
+		enc := string(encodeMapKey(k))
+		js := inB[enc]
+		if len(js) == 0 {
+			return note(keyPath, "key only in a"), true
+		}
+		j := js[0]
+		inB[enc] = js[1:]
+		matched[j] = true
+		if d, differ := e.diff(sa.Value[i], sb.Value[j], keyPath); differ {
+			return d, true
+		}
+	}
+	for j, ok := range matched {
+		if !ok {
+			return note(fmt.Sprintf("%s[%#v]", path, sb.Key[j]), "key only in b"), true
+		}
+	}
+	return "", false
+}
+
+// isLeaf reports whether print hashes v without recursing into it.
+func isLeaf(v reflect.Value) bool {
+	if v.CanInterface() && v.CanAddr() && implementsAppendTo(v.Type()) {
+		return true
+	}
+	if v.Type() == timeType {
+		return true
+	}
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Struct, reflect.Slice, reflect.Array, reflect.Interface, reflect.Map:
+		return false
+	}
+	return true
+}
+
+// encodeLeaf returns the bytes that print writes for the leaf value v.
+func encodeLeaf(v reflect.Value) []byte {
+	var buf bytes.Buffer
+	bw := bufio.NewWriter(&buf)
+	h := &hasher{
+		bw:      bw,
+		visited: map[uintptr]bool{},
+	}
+	h.print(v)
+	bw.Flush()
+	return buf.Bytes()
+}
+
+// encodeMapKey returns the bytes that print writes for the map key k.
+func encodeMapKey(k reflect.Value) []byte {
+	var buf bytes.Buffer
+	bw := bufio.NewWriter(&buf)
+	h := &hasher{
+		bw:         bw,
+		visited:    map[uintptr]bool{},
+		inMapEntry: true,
+	}
+	h.print(k)
+	bw.Flush()
+	return buf.Bytes()
+}
@@ -2,7 +2,7 @@
 // Use of this source code is governed by a BSD-style
 // license that can be found in the LICENSE file.
 
-// +build !tailscale_go
+// +build !tailscale_go,!go1.18
 
 package deephash
 